@@ -0,0 +1,6 @@
+package api
+
+// ResourcesAnnotation is the annotation of a sandbox config holding the
+// compute resources of the pod as JSON, which the runtime API has no field
+// for. ocid bounds the cgroup of the sandbox to them.
+const ResourcesAnnotation = "ocid/resources"
@@ -0,0 +1,392 @@
+// Package api defines the ocid extension service, which provides the
+// operations the kubelet runtime API does not cover yet. The messages are
+// written by hand in the form protoc-gen-go generates them, so that they
+// can be carried by gRPC along with the runtime API.
+package api
+
+import (
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// AttachRequest is sent by clients on an Attach stream. The first request
+// selects the container and whether to attach its stdin, the input of the
+// following ones is written to the stdin of the container.
+type AttachRequest struct {
+	// ContainerId is the ID of the container to attach to.
+	ContainerId string `protobuf:"bytes,1,opt,name=container_id,json=containerId" json:"container_id,omitempty"`
+	// Stdin tells whether to pass the input of the client to the stdin
+	// of the container.
+	Stdin bool `protobuf:"varint,2,opt,name=stdin" json:"stdin,omitempty"`
+	// Input is data for the stdin of the container.
+	Input []byte `protobuf:"bytes,3,opt,name=input,proto3" json:"input,omitempty"`
+}
+
+func (m *AttachRequest) Reset()         { *m = AttachRequest{} }
+func (m *AttachRequest) String() string { return proto.CompactTextString(m) }
+func (*AttachRequest) ProtoMessage()    {}
+
+// GetContainerId returns the ContainerId of the request.
+func (m *AttachRequest) GetContainerId() string {
+	if m != nil {
+		return m.ContainerId
+	}
+	return ""
+}
+
+// GetStdin returns the Stdin of the request.
+func (m *AttachRequest) GetStdin() bool {
+	if m != nil {
+		return m.Stdin
+	}
+	return false
+}
+
+// GetInput returns the Input of the request.
+func (m *AttachRequest) GetInput() []byte {
+	if m != nil {
+		return m.Input
+	}
+	return nil
+}
+
+// AttachResponse carries output of the container. The output of containers
+// with a terminal is all sent as stdout.
+type AttachResponse struct {
+	Stdout []byte `protobuf:"bytes,1,opt,name=stdout,proto3" json:"stdout,omitempty"`
+	Stderr []byte `protobuf:"bytes,2,opt,name=stderr,proto3" json:"stderr,omitempty"`
+}
+
+func (m *AttachResponse) Reset()         { *m = AttachResponse{} }
+func (m *AttachResponse) String() string { return proto.CompactTextString(m) }
+func (*AttachResponse) ProtoMessage()    {}
+
+// GetStdout returns the Stdout of the response.
+func (m *AttachResponse) GetStdout() []byte {
+	if m != nil {
+		return m.Stdout
+	}
+	return nil
+}
+
+// GetStderr returns the Stderr of the response.
+func (m *AttachResponse) GetStderr() []byte {
+	if m != nil {
+		return m.Stderr
+	}
+	return nil
+}
+
+// ResizeRequest sets the size of the terminal of an attach or exec session.
+type ResizeRequest struct {
+	// ContainerId is the ID of the container the session is in.
+	ContainerId string `protobuf:"bytes,1,opt,name=container_id,json=containerId" json:"container_id,omitempty"`
+	// ExecId is the ID of the exec session, as sent in the header
+	// metadata of its stream. The terminal of the container itself,
+	// which attach sessions use, is resized when it is empty.
+	ExecId string `protobuf:"bytes,2,opt,name=exec_id,json=execId" json:"exec_id,omitempty"`
+	// Width is the number of columns of the terminal.
+	Width uint32 `protobuf:"varint,3,opt,name=width" json:"width,omitempty"`
+	// Height is the number of rows of the terminal.
+	Height uint32 `protobuf:"varint,4,opt,name=height" json:"height,omitempty"`
+}
+
+func (m *ResizeRequest) Reset()         { *m = ResizeRequest{} }
+func (m *ResizeRequest) String() string { return proto.CompactTextString(m) }
+func (*ResizeRequest) ProtoMessage()    {}
+
+// GetContainerId returns the ContainerId of the request.
+func (m *ResizeRequest) GetContainerId() string {
+	if m != nil {
+		return m.ContainerId
+	}
+	return ""
+}
+
+// GetExecId returns the ExecId of the request.
+func (m *ResizeRequest) GetExecId() string {
+	if m != nil {
+		return m.ExecId
+	}
+	return ""
+}
+
+// GetWidth returns the Width of the request.
+func (m *ResizeRequest) GetWidth() uint32 {
+	if m != nil {
+		return m.Width
+	}
+	return 0
+}
+
+// GetHeight returns the Height of the request.
+func (m *ResizeRequest) GetHeight() uint32 {
+	if m != nil {
+		return m.Height
+	}
+	return 0
+}
+
+// ResizeResponse is the response to a ResizeRequest.
+type ResizeResponse struct {
+}
+
+func (m *ResizeResponse) Reset()         { *m = ResizeResponse{} }
+func (m *ResizeResponse) String() string { return proto.CompactTextString(m) }
+func (*ResizeResponse) ProtoMessage()    {}
+
+// ExecSyncRequest runs a command in a container and waits for it to exit.
+type ExecSyncRequest struct {
+	// ContainerId is the ID of the container to run the command in.
+	ContainerId string `protobuf:"bytes,1,opt,name=container_id,json=containerId" json:"container_id,omitempty"`
+	// Cmd is the command to run.
+	Cmd []string `protobuf:"bytes,2,rep,name=cmd" json:"cmd,omitempty"`
+	// Timeout is the number of seconds after which the command is
+	// killed, it is not limited when zero.
+	Timeout int64 `protobuf:"varint,3,opt,name=timeout" json:"timeout,omitempty"`
+}
+
+func (m *ExecSyncRequest) Reset()         { *m = ExecSyncRequest{} }
+func (m *ExecSyncRequest) String() string { return proto.CompactTextString(m) }
+func (*ExecSyncRequest) ProtoMessage()    {}
+
+// GetContainerId returns the ContainerId of the request.
+func (m *ExecSyncRequest) GetContainerId() string {
+	if m != nil {
+		return m.ContainerId
+	}
+	return ""
+}
+
+// GetCmd returns the Cmd of the request.
+func (m *ExecSyncRequest) GetCmd() []string {
+	if m != nil {
+		return m.Cmd
+	}
+	return nil
+}
+
+// GetTimeout returns the Timeout of the request.
+func (m *ExecSyncRequest) GetTimeout() int64 {
+	if m != nil {
+		return m.Timeout
+	}
+	return 0
+}
+
+// ExecSyncResponse carries the output and exit code of the command.
+type ExecSyncResponse struct {
+	Stdout   []byte `protobuf:"bytes,1,opt,name=stdout,proto3" json:"stdout,omitempty"`
+	Stderr   []byte `protobuf:"bytes,2,opt,name=stderr,proto3" json:"stderr,omitempty"`
+	ExitCode int32  `protobuf:"varint,3,opt,name=exit_code,json=exitCode" json:"exit_code,omitempty"`
+}
+
+func (m *ExecSyncResponse) Reset()         { *m = ExecSyncResponse{} }
+func (m *ExecSyncResponse) String() string { return proto.CompactTextString(m) }
+func (*ExecSyncResponse) ProtoMessage()    {}
+
+// GetStdout returns the Stdout of the response.
+func (m *ExecSyncResponse) GetStdout() []byte {
+	if m != nil {
+		return m.Stdout
+	}
+	return nil
+}
+
+// GetStderr returns the Stderr of the response.
+func (m *ExecSyncResponse) GetStderr() []byte {
+	if m != nil {
+		return m.Stderr
+	}
+	return nil
+}
+
+// GetExitCode returns the ExitCode of the response.
+func (m *ExecSyncResponse) GetExitCode() int32 {
+	if m != nil {
+		return m.ExitCode
+	}
+	return 0
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// Client API for ExtensionService service
+
+// ExtensionServiceClient is the client API for the extension service.
+type ExtensionServiceClient interface {
+	// Attach attaches to the stdio of a running container.
+	Attach(ctx context.Context, opts ...grpc.CallOption) (ExtensionService_AttachClient, error)
+	// Resize sets the size of the terminal of an attach or exec session.
+	Resize(ctx context.Context, in *ResizeRequest, opts ...grpc.CallOption) (*ResizeResponse, error)
+	// ExecSync runs a command in a container and returns its output and
+	// exit code.
+	ExecSync(ctx context.Context, in *ExecSyncRequest, opts ...grpc.CallOption) (*ExecSyncResponse, error)
+}
+
+type extensionServiceClient struct {
+	cc *grpc.ClientConn
+}
+
+// NewExtensionServiceClient returns a client of the extension service
+// served on cc.
+func NewExtensionServiceClient(cc *grpc.ClientConn) ExtensionServiceClient {
+	return &extensionServiceClient{cc}
+}
+
+func (c *extensionServiceClient) Attach(ctx context.Context, opts ...grpc.CallOption) (ExtensionService_AttachClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_ExtensionService_serviceDesc.Streams[0], c.cc, "/api.ExtensionService/Attach", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &extensionServiceAttachClient{stream}
+	return x, nil
+}
+
+func (c *extensionServiceClient) Resize(ctx context.Context, in *ResizeRequest, opts ...grpc.CallOption) (*ResizeResponse, error) {
+	out := new(ResizeResponse)
+	err := grpc.Invoke(ctx, "/api.ExtensionService/Resize", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *extensionServiceClient) ExecSync(ctx context.Context, in *ExecSyncRequest, opts ...grpc.CallOption) (*ExecSyncResponse, error) {
+	out := new(ExecSyncResponse)
+	err := grpc.Invoke(ctx, "/api.ExtensionService/ExecSync", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ExtensionService_AttachClient is the client side of an Attach stream.
+type ExtensionService_AttachClient interface {
+	Send(*AttachRequest) error
+	Recv() (*AttachResponse, error)
+	grpc.ClientStream
+}
+
+type extensionServiceAttachClient struct {
+	grpc.ClientStream
+}
+
+func (x *extensionServiceAttachClient) Send(m *AttachRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *extensionServiceAttachClient) Recv() (*AttachResponse, error) {
+	m := new(AttachResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Server API for ExtensionService service
+
+// ExtensionServiceServer is the server API for the extension service.
+type ExtensionServiceServer interface {
+	// Attach attaches to the stdio of a running container.
+	Attach(ExtensionService_AttachServer) error
+	// Resize sets the size of the terminal of an attach or exec session.
+	Resize(context.Context, *ResizeRequest) (*ResizeResponse, error)
+	// ExecSync runs a command in a container and returns its output and
+	// exit code.
+	ExecSync(context.Context, *ExecSyncRequest) (*ExecSyncResponse, error)
+}
+
+// RegisterExtensionServiceServer registers srv as the extension service of s.
+func RegisterExtensionServiceServer(s *grpc.Server, srv ExtensionServiceServer) {
+	s.RegisterService(&_ExtensionService_serviceDesc, srv)
+}
+
+func _ExtensionService_Attach_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ExtensionServiceServer).Attach(&extensionServiceAttachServer{stream})
+}
+
+// ExtensionService_AttachServer is the server side of an Attach stream.
+type ExtensionService_AttachServer interface {
+	Send(*AttachResponse) error
+	Recv() (*AttachRequest, error)
+	grpc.ServerStream
+}
+
+type extensionServiceAttachServer struct {
+	grpc.ServerStream
+}
+
+func (x *extensionServiceAttachServer) Send(m *AttachResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *extensionServiceAttachServer) Recv() (*AttachRequest, error) {
+	m := new(AttachRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _ExtensionService_Resize_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResizeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ExtensionServiceServer).Resize(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.ExtensionService/Resize",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ExtensionServiceServer).Resize(ctx, req.(*ResizeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ExtensionService_ExecSync_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExecSyncRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ExtensionServiceServer).ExecSync(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.ExtensionService/ExecSync",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ExtensionServiceServer).ExecSync(ctx, req.(*ExecSyncRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _ExtensionService_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "api.ExtensionService",
+	HandlerType: (*ExtensionServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Resize",
+			Handler:    _ExtensionService_Resize_Handler,
+		},
+		{
+			MethodName: "ExecSync",
+			Handler:    _ExtensionService_ExecSync_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Attach",
+			Handler:       _ExtensionService_Attach_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+}
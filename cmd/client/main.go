@@ -3,15 +3,22 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/kubernetes-incubator/ocid/api"
+	"github.com/kubernetes-incubator/ocid/utils"
 	pb "github.com/kubernetes/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
 	"github.com/urfave/cli"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
 const (
@@ -49,10 +56,28 @@ func loadPodSandboxConfig(path string) (*pb.PodSandboxConfig, error) {
 	}
 	defer f.Close()
 
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
 	var config pb.PodSandboxConfig
-	if err := json.NewDecoder(f).Decode(&config); err != nil {
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	// the runtime API has no field for the resources of the pod, ocid
+	// reads them from an annotation
+	var extra struct {
+		Resources json.RawMessage `json:"resources"`
+	}
+	if err := json.Unmarshal(data, &extra); err != nil {
 		return nil, err
 	}
+	if extra.Resources != nil {
+		if config.Annotations == nil {
+			config.Annotations = make(map[string]string)
+		}
+		config.Annotations[api.ResourcesAnnotation] = string(extra.Resources)
+	}
 	return &config, nil
 }
 
@@ -165,12 +190,13 @@ func StartContainer(client pb.RuntimeServiceClient, ID string) error {
 
 // StopContainer sends a StopContainerRequest to the server, and parses
 // the returned StopContainerResponse.
-func StopContainer(client pb.RuntimeServiceClient, ID string) error {
+func StopContainer(client pb.RuntimeServiceClient, ID string, timeout int64) error {
 	if ID == "" {
 		return fmt.Errorf("ID cannot be empty")
 	}
 	_, err := client.StopContainer(context.Background(), &pb.StopContainerRequest{
 		ContainerId: &ID,
+		Timeout:     &timeout,
 	})
 	if err != nil {
 		return err
@@ -195,6 +221,211 @@ func RemoveContainer(client pb.RuntimeServiceClient, ID string) error {
 	return nil
 }
 
+// ExecSync runs a command in a container with an ExecSyncRequest, prints
+// its output and fails if it does not exit successfully.
+func ExecSync(client api.ExtensionServiceClient, ID string, cmd []string, timeout int64) error {
+	if ID == "" {
+		return fmt.Errorf("ID cannot be empty")
+	}
+	r, err := client.ExecSync(context.Background(), &api.ExecSyncRequest{
+		ContainerId: ID,
+		Cmd:         cmd,
+		Timeout:     timeout,
+	})
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(r.GetStdout())
+	os.Stderr.Write(r.GetStderr())
+	if r.GetExitCode() != 0 {
+		return fmt.Errorf("command exited with status %d", r.GetExitCode())
+	}
+	return nil
+}
+
+// Exec runs cmd in a container, passing it the input if stdin is set, and
+// waits for it to exit. With tty, the command runs with a terminal whose
+// size follows the local one.
+func Exec(client pb.RuntimeServiceClient, ext api.ExtensionServiceClient, ID string, cmd []string, stdin bool, tty bool) error {
+	if ID == "" {
+		return fmt.Errorf("ID cannot be empty")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.Exec(ctx)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(&pb.ExecRequest{ContainerId: &ID, Cmd: cmd, Tty: &tty}); err != nil {
+		return err
+	}
+	if !stdin {
+		stream.CloseSend()
+	}
+
+	if tty && utils.IsTerminal(os.Stdin.Fd()) {
+		// the ID of the session, which Resize needs, comes in the header
+		header, err := stream.Header()
+		if err != nil {
+			return err
+		}
+		state, err := utils.SetRawTerminal(os.Stdin.Fd())
+		if err != nil {
+			return err
+		}
+		defer utils.RestoreTerminal(os.Stdin.Fd(), state)
+		if ids := header["exec-id"]; len(ids) > 0 {
+			go forwardResize(ctx, ext, ID, ids[0])
+		}
+	}
+
+	if stdin {
+		go func() {
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := os.Stdin.Read(buf)
+				if n > 0 {
+					input := make([]byte, n)
+					copy(input, buf[:n])
+					if err := stream.Send(&pb.ExecRequest{Stdin: input}); err != nil {
+						return
+					}
+				}
+				if err != nil {
+					stream.CloseSend()
+					return
+				}
+			}
+		}()
+	}
+
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(resp.GetStdout())
+		os.Stderr.Write(resp.GetStderr())
+	}
+	if codes := stream.Trailer()["exit-code"]; len(codes) > 0 && codes[0] != "0" {
+		return fmt.Errorf("command exited with status %s", codes[0])
+	}
+	return nil
+}
+
+// detachKeys is the input sequence, ctrl-p ctrl-q, which detaches from a
+// container with a terminal.
+var detachKeys = []byte{16, 17}
+
+// AttachContainer attaches to the stdio of a container until it exits or,
+// when it has a terminal, until the detach keys are typed.
+func AttachContainer(client api.ExtensionServiceClient, ID string, stdin bool, tty bool) error {
+	if ID == "" {
+		return fmt.Errorf("ID cannot be empty")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.Attach(ctx)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(&api.AttachRequest{ContainerId: ID, Stdin: stdin}); err != nil {
+		return err
+	}
+
+	if tty && utils.IsTerminal(os.Stdin.Fd()) {
+		state, err := utils.SetRawTerminal(os.Stdin.Fd())
+		if err != nil {
+			return err
+		}
+		defer utils.RestoreTerminal(os.Stdin.Fd(), state)
+		go forwardResize(ctx, client, ID, "")
+	}
+
+	detached := make(chan struct{})
+	if stdin {
+		go func() {
+			buf := make([]byte, 32*1024)
+			matched := 0
+			for {
+				n, err := os.Stdin.Read(buf)
+				if n > 0 {
+					input := make([]byte, n)
+					copy(input, buf[:n])
+					if tty {
+						for i, b := range input {
+							if b != detachKeys[matched] {
+								matched = 0
+							}
+							if b == detachKeys[matched] {
+								matched++
+							}
+							if matched == len(detachKeys) {
+								if start := i + 1 - len(detachKeys); start > 0 {
+									stream.Send(&api.AttachRequest{Input: input[:start]})
+								}
+								close(detached)
+								cancel()
+								return
+							}
+						}
+					}
+					if err := stream.Send(&api.AttachRequest{Input: input}); err != nil {
+						return
+					}
+				}
+				if err != nil {
+					stream.CloseSend()
+					return
+				}
+			}
+		}()
+	}
+
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			select {
+			case <-detached:
+				return nil
+			default:
+				return err
+			}
+		}
+		os.Stdout.Write(resp.GetStdout())
+		os.Stderr.Write(resp.GetStderr())
+	}
+}
+
+// forwardResize keeps the size of the terminal of the container, or of its
+// exec session execID if set, in sync with the local one until ctx is done.
+func forwardResize(ctx context.Context, client api.ExtensionServiceClient, ID string, execID string) {
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+
+	for {
+		width, height, err := utils.GetWinsize(os.Stdin.Fd())
+		if err == nil {
+			_, err = client.Resize(ctx, &api.ResizeRequest{ContainerId: ID, ExecId: execID, Width: uint32(width), Height: uint32(height)})
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("failed to resize the terminal of container %s: %v", ID, err)
+		}
+		select {
+		case <-winch:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 // Version sends a VersionRequest to the server, and parses the returned VersionResponse.
 func Version(client pb.RuntimeServiceClient, version string) error {
 	r, err := client.Version(context.Background(), &pb.VersionRequest{Version: &version})
@@ -216,6 +447,7 @@ func main() {
 		containerCommand,
 		runtimeVersionCommand,
 		pullImageCommand,
+		removeImageCommand,
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -231,6 +463,24 @@ func PullImage(client pb.ImageServiceClient, image string) error {
 	return nil
 }
 
+// RemoveImage sends a RemoveImageRequest to the server. Images used by
+// containers are only removed when force is set.
+func RemoveImage(client pb.ImageServiceClient, image string, force bool) error {
+	if image == "" {
+		return fmt.Errorf("image name cannot be empty")
+	}
+	ctx := context.Background()
+	if force {
+		ctx = metadata.NewContext(ctx, metadata.Pairs("ocid-force-remove", "true"))
+	}
+	_, err := client.RemoveImage(ctx, &pb.RemoveImageRequest{Image: &pb.ImageSpec{Image: &image}})
+	if err != nil {
+		return err
+	}
+	fmt.Println(image)
+	return nil
+}
+
 // try this with ./ocic pullimage docker://busybox
 var pullImageCommand = cli.Command{
 	Name:  "pullimage",
@@ -252,6 +502,32 @@ var pullImageCommand = cli.Command{
 	},
 }
 
+var removeImageCommand = cli.Command{
+	Name:  "removeimage",
+	Usage: "remove an image",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "force",
+			Usage: "remove the image even if containers were created from it",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		// Set up a connection to the server.
+		conn, err := getClientConnection()
+		if err != nil {
+			return fmt.Errorf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+		client := pb.NewImageServiceClient(conn)
+
+		err = RemoveImage(client, context.Args().Get(0), context.Bool("force"))
+		if err != nil {
+			return fmt.Errorf("removing image failed: %v", err)
+		}
+		return nil
+	},
+}
+
 var runtimeVersionCommand = cli.Command{
 	Name:  "runtimeversion",
 	Usage: "get runtime version information",
@@ -401,6 +677,8 @@ var containerCommand = cli.Command{
 		startContainerCommand,
 		stopContainerCommand,
 		removeContainerCommand,
+		attachContainerCommand,
+		execContainerCommand,
 	},
 }
 
@@ -475,6 +753,11 @@ var stopContainerCommand = cli.Command{
 			Value: "",
 			Usage: "id of the container",
 		},
+		cli.Int64Flag{
+			Name:  "timeout",
+			Value: 10,
+			Usage: "seconds to wait for the container to stop before killing it",
+		},
 	},
 	Action: func(context *cli.Context) error {
 		// Set up a connection to the server.
@@ -485,7 +768,7 @@ var stopContainerCommand = cli.Command{
 		defer conn.Close()
 		client := pb.NewRuntimeServiceClient(conn)
 
-		err = StopContainer(client, context.String("id"))
+		err = StopContainer(client, context.String("id"), context.Int64("timeout"))
 		if err != nil {
 			return fmt.Errorf("Stopping the container failed: %v", err)
 		}
@@ -519,3 +802,86 @@ var removeContainerCommand = cli.Command{
 		return nil
 	},
 }
+
+var attachContainerCommand = cli.Command{
+	Name:  "attach",
+	Usage: "attach to the stdio of a running container",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "id",
+			Value: "",
+			Usage: "id of the container",
+		},
+		cli.BoolFlag{
+			Name:  "stdin",
+			Usage: "pass the input to the stdin of the container",
+		},
+		cli.BoolFlag{
+			Name:  "tty",
+			Usage: "put the terminal in raw mode, for containers with a terminal. Type ctrl-p ctrl-q to detach",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		// Set up a connection to the server.
+		conn, err := getClientConnection()
+		if err != nil {
+			return fmt.Errorf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+		client := api.NewExtensionServiceClient(conn)
+
+		err = AttachContainer(client, context.String("id"), context.Bool("stdin"), context.Bool("tty"))
+		if err != nil {
+			return fmt.Errorf("Attaching to the container failed: %v", err)
+		}
+		return nil
+	},
+}
+
+var execContainerCommand = cli.Command{
+	Name:      "exec",
+	Usage:     "run a command in a running container and wait for it to exit",
+	ArgsUsage: "COMMAND [ARG...]",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "id",
+			Value: "",
+			Usage: "id of the container",
+		},
+		cli.Int64Flag{
+			Name:  "timeout",
+			Value: 0,
+			Usage: "seconds after which the command is killed, 0 for no timeout, ignored with --stdin or --tty",
+		},
+		cli.BoolFlag{
+			Name:  "stdin",
+			Usage: "pass the input to the stdin of the command",
+		},
+		cli.BoolFlag{
+			Name:  "tty",
+			Usage: "run the command with a terminal, putting the local one in raw mode",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		// Set up a connection to the server.
+		conn, err := getClientConnection()
+		if err != nil {
+			return fmt.Errorf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+		client := api.NewExtensionServiceClient(conn)
+
+		if len(context.Args()) == 0 {
+			return fmt.Errorf("Please specify the command to run")
+		}
+		if context.Bool("stdin") || context.Bool("tty") {
+			err = Exec(pb.NewRuntimeServiceClient(conn), client, context.String("id"), context.Args(), context.Bool("stdin"), context.Bool("tty"))
+		} else {
+			err = ExecSync(client, context.String("id"), context.Args(), context.Int64("timeout"))
+		}
+		if err != nil {
+			return fmt.Errorf("Running the command failed: %v", err)
+		}
+		return nil
+	},
+}
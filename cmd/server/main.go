@@ -5,6 +5,7 @@ import (
 	"net"
 	"os"
 
+	"github.com/kubernetes-incubator/ocid/api"
 	"github.com/kubernetes-incubator/ocid/server"
 	"github.com/kubernetes/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
 	"github.com/urfave/cli"
@@ -31,11 +32,40 @@ func main() {
 			Value: "/usr/bin/runc",
 			Usage: "OCI runtime path",
 		},
+		cli.StringFlag{
+			Name:  "conmon",
+			Value: "/usr/libexec/ocid/conmon",
+			Usage: "path to the conmon binary monitoring containers",
+		},
 		cli.StringFlag{
 			Name:  "containerdir",
 			Value: "/var/lib/ocid/containers",
 			Usage: "ocid container dir",
 		},
+		cli.StringFlag{
+			Name:  "pauseimage",
+			Value: "docker://gcr.io/google_containers/pause-amd64:3.0",
+			Usage: "image the pod sandbox infra containers run from",
+		},
+		cli.StringFlag{
+			Name:  "pausecommand",
+			Value: "/pause",
+			Usage: "command run by the pod sandbox infra containers",
+		},
+		cli.Int64Flag{
+			Name:  "log-size-max",
+			Value: -1,
+			Usage: "maximum size in bytes of a container log file before it is rotated, negative for no limit",
+		},
+		cli.IntFlag{
+			Name:  "log-max-files",
+			Value: 5,
+			Usage: "number of rotated log files kept per container",
+		},
+		cli.StringSliceFlag{
+			Name:  "insecure-registry",
+			Usage: "registry which may be pulled from, with credentials, over plain http, may be repeated",
+		},
 	}
 
 	app.Action = func(c *cli.Context) error {
@@ -54,13 +84,14 @@ func main() {
 
 		containerDir := c.String("containerdir")
 		sandboxDir := c.String("sandboxdir")
-		service, err := server.New(c.String("runtime"), sandboxDir, containerDir)
+		service, err := server.New(c.String("runtime"), c.String("conmon"), sandboxDir, containerDir, c.String("pauseimage"), c.String("pausecommand"), c.Int64("log-size-max"), c.Int("log-max-files"), c.StringSlice("insecure-registry"))
 		if err != nil {
 			log.Fatal(err)
 		}
 
 		runtime.RegisterRuntimeServiceServer(s, service)
 		runtime.RegisterImageServiceServer(s, service)
+		api.RegisterExtensionServiceServer(s, service)
 		s.Serve(lis)
 		return nil
 	}
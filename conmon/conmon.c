@@ -1,14 +1,23 @@
 #define _GNU_SOURCE
 #include <errno.h>
 #include <fcntl.h>
+#include <signal.h>
 #include <stdbool.h>
+#include <stdint.h>
 #include <stdio.h>
 #include <stdlib.h>
 #include <string.h>
 #include <sys/epoll.h>
+#include <sys/eventfd.h>
+#include <sys/ioctl.h>
 #include <sys/prctl.h>
+#include <sys/signalfd.h>
+#include <sys/socket.h>
+#include <sys/stat.h>
+#include <sys/un.h>
 #include <sys/wait.h>
 #include <termios.h>
+#include <time.h>
 #include <unistd.h>
 
 #include <glib.h>
@@ -40,46 +49,802 @@ static inline void closep(int *fd) {
 	*fd = -1;
 }
 
+static inline void gstring_free_cleanup(GString **string)
+{
+	if (*string)
+		g_string_free(*string, TRUE);
+}
+
 #define _cleanup_free_ _cleanup_(freep)
 #define _cleanup_close_ _cleanup_(closep)
+#define _cleanup_gstring_ _cleanup_(gstring_free_cleanup)
+
+#define BUF_SIZE 8192
+#define MAX_EVENTS 10
+
+static char *cid = NULL;
+static char *runtime_path = NULL;
+static char *bundle_path = NULL;
+static char *pid_file = NULL;
+static char *log_path = NULL;
+static char *exit_file = NULL;
+static char *oom_file = NULL;
+static gboolean terminal = FALSE;
+static gboolean systemd_cgroup = FALSE;
+static gint64 log_size_max = -1;
+static gint log_max_files = 0;
+static gboolean opt_stdin = FALSE;
+static gboolean stdin_once = FALSE;
+static char *attach_socket_path = NULL;
 
-struct termios tty_orig;
+static GOptionEntry entries[] = {
+	{ "cid", 'c', 0, G_OPTION_ARG_STRING, &cid, "Container ID", NULL },
+	{ "runtime", 'r', 0, G_OPTION_ARG_STRING, &runtime_path, "Runtime path", NULL },
+	{ "bundle", 'b', 0, G_OPTION_ARG_STRING, &bundle_path, "Bundle path", NULL },
+	{ "pidfile", 'p', 0, G_OPTION_ARG_STRING, &pid_file, "PID file", NULL },
+	{ "log-path", 'l', 0, G_OPTION_ARG_STRING, &log_path, "Log file path", NULL },
+	{ "exit-file", 'e', 0, G_OPTION_ARG_STRING, &exit_file, "Exit file path", NULL },
+	{ "oom-file", 'o', 0, G_OPTION_ARG_STRING, &oom_file, "File created when the container is OOM-killed", NULL },
+	{ "terminal", 't', 0, G_OPTION_ARG_NONE, &terminal, "Terminal", NULL },
+	{ "systemd-cgroup", 's', 0, G_OPTION_ARG_NONE, &systemd_cgroup, "Enable systemd cgroup manager", NULL },
+	{ "log-size-max", 0, 0, G_OPTION_ARG_INT64, &log_size_max, "Maximum size of the log file before it is rotated", NULL },
+	{ "log-max-files", 0, 0, G_OPTION_ARG_INT, &log_max_files, "Number of rotated log files to keep", NULL },
+	{ "stdin", 'i', 0, G_OPTION_ARG_NONE, &opt_stdin, "Keep the stdin of the container open", NULL },
+	{ "stdin-once", 0, 0, G_OPTION_ARG_NONE, &stdin_once, "Close stdin once the first attached client is done with it", NULL },
+	{ "attach-socket", 'a', 0, G_OPTION_ARG_STRING, &attach_socket_path, "Path of the socket clients attach to", NULL },
+	{ NULL }
+};
 
-static void tty_restore(void)
+/* write_all writes all of buf to fd, retrying on short writes. */
+static ssize_t write_all(int fd, const void *buf, size_t count)
 {
-	if (tcsetattr(STDIN_FILENO, TCSANOW, &tty_orig) == -1)
-		pexit("tcsetattr");
+	size_t remaining = count;
+	const char *p = buf;
+	ssize_t res;
+
+	while (remaining > 0) {
+		do {
+			res = write(fd, p, remaining);
+		} while (res == -1 && errno == EINTR);
+
+		if (res <= 0)
+			return -1;
+
+		remaining -= res;
+		p += res;
+	}
+
+	return count;
 }
 
-#define BUF_SIZE 256
-#define CMD_SIZE 1024
-#define MAX_EVENTS 10
+/* json_escape appends s to out as the content of a JSON string. */
+static void json_escape(GString *out, const char *s)
+{
+	for (; *s; s++) {
+		switch (*s) {
+		case '"':
+			g_string_append(out, "\\\"");
+			break;
+		case '\\':
+			g_string_append(out, "\\\\");
+			break;
+		case '\n':
+			g_string_append(out, "\\n");
+			break;
+		default:
+			if ((unsigned char)*s < 0x20)
+				g_string_append_printf(out, "\\u%04x", (unsigned char)*s);
+			else
+				g_string_append_c(out, *s);
+		}
+	}
+}
+
+/*
+ * write_sync reports the pid of the container, or why it could not be
+ * created, to ocid on the sync pipe.
+ */
+static void write_sync(int sync_fd, int pid, const char *message)
+{
+	_cleanup_gstring_ GString *msg = g_string_new(NULL);
+
+	if (sync_fd < 0)
+		return;
+
+	g_string_append_printf(msg, "{\"pid\": %d", pid);
+	if (message) {
+		g_string_append(msg, ", \"message\": \"");
+		json_escape(msg, message);
+		g_string_append(msg, "\"");
+	}
+	g_string_append(msg, "}\n");
+
+	if (write_all(sync_fd, msg->str, msg->len) < 0)
+		nwarn("Failed to write to the sync pipe");
+}
+
+/* read_all reads fd until EOF. */
+static GString *read_all(int fd)
+{
+	GString *out = g_string_new(NULL);
+	char buf[BUF_SIZE];
+	ssize_t num_read;
+
+	while ((num_read = read(fd, buf, BUF_SIZE)) != 0) {
+		if (num_read < 0) {
+			if (errno == EINTR)
+				continue;
+			break;
+		}
+		g_string_append_len(out, buf, num_read);
+	}
+
+	return out;
+}
+
+#define STDOUT_STREAM "stdout"
+#define STDERR_STREAM "stderr"
+
+/* The log file of the container and the number of bytes written to it */
+static int log_fd = -1;
+static gint64 log_size = 0;
+
+/* open_log opens the log file for appending, creating it if needed. */
+static int open_log(void)
+{
+	struct stat st;
+
+	log_fd = open(log_path, O_WRONLY | O_APPEND | O_CREAT | O_CLOEXEC, 0600);
+	if (log_fd < 0)
+		return -1;
+	if (fstat(log_fd, &st) < 0)
+		return -1;
+	log_size = st.st_size;
+	return 0;
+}
+
+/*
+ * rotate_log moves the log file to <log path>.1, shifting the older
+ * rotated files and dropping the ones beyond log_max_files, and opens a
+ * new log file. The files are renamed so that readers following the log
+ * finish reading the old file before switching to the new one.
+ */
+static void rotate_log(void)
+{
+	_cleanup_free_ char *from = NULL;
+	_cleanup_free_ char *to = NULL;
+
+	if (log_max_files > 0) {
+		for (int i = log_max_files - 1; i >= 0; i--) {
+			free(from);
+			free(to);
+			from = NULL;
+			to = NULL;
+			if ((i == 0 ? asprintf(&from, "%s", log_path) : asprintf(&from, "%s.%d", log_path, i)) < 0 ||
+			    asprintf(&to, "%s.%d", log_path, i + 1) < 0) {
+				nwarn("Failed to allocate memory to rotate the log");
+				return;
+			}
+			if (rename(from, to) < 0 && errno != ENOENT) {
+				nwarn("Failed to rename %s to %s: %m", from, to);
+				return;
+			}
+		}
+	} else if (unlink(log_path) < 0 && errno != ENOENT) {
+		nwarn("Failed to remove %s: %m", log_path);
+		return;
+	}
+
+	closep(&log_fd);
+	if (open_log() < 0)
+		pexit("Failed to reopen log file %s", log_path);
+}
+
+/*
+ * write_log writes records to the log, rotating it first when it would
+ * grow beyond log_size_max.
+ */
+static int write_log(GString *records)
+{
+	if (log_size_max > 0 && log_size > 0 && log_size + (gint64)records->len > log_size_max)
+		rotate_log();
+	if (write_all(log_fd, records->str, records->len) < 0)
+		return -1;
+	log_size += records->len;
+	g_string_truncate(records, 0);
+	return 0;
+}
+
+/*
+ * write_k8s_log writes buf, read from the given stream of the container,
+ * to the log in the format expected by kubernetes:
+ *
+ *   <RFC3339Nano timestamp> <stream> <P|F> <content>
+ *
+ * where F marks complete lines and P partial ones, the rest of which
+ * follows in the next entries. Rotation only happens between entries.
+ */
+static int write_k8s_log(const char *stream, const char *buf, ssize_t buflen)
+{
+	_cleanup_gstring_ GString *out = g_string_new(NULL);
+	_cleanup_gstring_ GString *record = g_string_new(NULL);
+	struct timespec ts;
+	struct tm tm;
+	char tsbuf[64];
+
+	if (clock_gettime(CLOCK_REALTIME, &ts) < 0 || gmtime_r(&ts.tv_sec, &tm) == NULL)
+		return -1;
+	if (strftime(tsbuf, sizeof(tsbuf), "%Y-%m-%dT%H:%M:%S", &tm) == 0)
+		return -1;
+
+	while (buflen > 0) {
+		const char *nl = memchr(buf, '\n', buflen);
+		ssize_t line_len = nl ? nl - buf + 1 : buflen;
+
+		g_string_printf(record, "%s.%09ldZ %s %c ", tsbuf, ts.tv_nsec, stream, nl ? 'F' : 'P');
+		g_string_append_len(record, buf, nl ? line_len - 1 : line_len);
+		g_string_append_c(record, '\n');
+
+		/* flush what fits before the log has to be rotated */
+		if (log_size_max > 0 && out->len > 0 &&
+		    log_size + (gint64)(out->len + record->len) > log_size_max) {
+			if (write_log(out) < 0)
+				return -1;
+		}
+		g_string_append_len(out, record->str, record->len);
+
+		buf += line_len;
+		buflen -= line_len;
+	}
+
+	return out->len > 0 ? write_log(out) : 0;
+}
+
+/* exit_code converts a wait status to the exit code reported by shells. */
+static int exit_code(int status)
+{
+	if (WIFSIGNALED(status))
+		return 128 + WTERMSIG(status);
+	return WEXITSTATUS(status);
+}
+
+/*
+ * Messages on the attach socket start with their kind. Clients receive the
+ * output of the container and send it input and control messages.
+ */
+#define ATTACH_MSG_STDOUT 1
+#define ATTACH_MSG_STDERR 2
+#define ATTACH_MSG_STDIN 1
+#define ATTACH_MSG_CLOSE_STDIN 2
+#define ATTACH_MSG_RESIZE 3
+
+#define MAX_ATTACH_CLIENTS 16
+
+static int attach_clients[MAX_ATTACH_CLIENTS];
+/* Whether the client at the same index attached to stdin */
+static bool attach_client_stdin[MAX_ATTACH_CLIENTS];
+
+/*
+ * The stdin of the container: the write end of its stdin pipe, or the
+ * master pty for a terminal. -1 when stdin is not open.
+ */
+static int container_stdin_fd = -1;
+static bool container_stdin_is_pipe = false;
+
+/*
+ * Input the container has not taken yet. Stdin is non-blocking so that a
+ * container which does not read it cannot stall conmon; its input is kept
+ * until it can take it, up to STDIN_BUF_MAX, and dropped beyond.
+ */
+#define STDIN_BUF_MAX (1024 * 1024)
+static GString *stdin_buf = NULL;
+/* Whether stdin is closed once stdin_buf is flushed */
+static bool stdin_close_pending = false;
+/* Whether epoll reports when the container can take more input */
+static bool stdin_watched = false;
+/* Whether input is being dropped, to warn once about it */
+static bool stdin_dropping = false;
+
+/* The master pty of the container, -1 when it has no terminal */
+static int container_terminal_fd = -1;
+
+/* setup_attach_socket starts listening for clients on the attach socket. */
+static int setup_attach_socket(void)
+{
+	struct sockaddr_un addr = { .sun_family = AF_UNIX };
+	int fd;
+
+	if (strlen(attach_socket_path) >= sizeof(addr.sun_path))
+		nexit("Attach socket path %s is too long", attach_socket_path);
+	strcpy(addr.sun_path, attach_socket_path);
+	unlink(attach_socket_path);
+
+	fd = socket(AF_UNIX, SOCK_SEQPACKET | SOCK_NONBLOCK | SOCK_CLOEXEC, 0);
+	if (fd < 0)
+		pexit("Failed to create the attach socket");
+	if (bind(fd, (struct sockaddr *)&addr, sizeof(addr)) < 0)
+		pexit("Failed to bind the attach socket %s", attach_socket_path);
+	if (chmod(attach_socket_path, 0700) < 0)
+		pexit("Failed to change the mode of the attach socket");
+	if (listen(fd, 10) < 0)
+		pexit("Failed to listen on the attach socket");
+
+	for (int i = 0; i < MAX_ATTACH_CLIENTS; i++)
+		attach_clients[i] = -1;
+	return fd;
+}
+
+/* accept_attach_client adds a client connecting on the attach socket. */
+static void accept_attach_client(int epfd, int afd)
+{
+	struct epoll_event ev = { .events = EPOLLIN };
+	int fd;
+	int i;
+
+	fd = accept4(afd, NULL, NULL, SOCK_CLOEXEC);
+	if (fd < 0) {
+		nwarn("Failed to accept an attach client: %m");
+		return;
+	}
+	for (i = 0; i < MAX_ATTACH_CLIENTS && attach_clients[i] >= 0; i++)
+		;
+	if (i == MAX_ATTACH_CLIENTS) {
+		nwarn("Too many attach clients");
+		close(fd);
+		return;
+	}
+
+	ev.data.fd = fd;
+	if (epoll_ctl(epfd, EPOLL_CTL_ADD, fd, &ev) < 0) {
+		nwarn("Failed to add an attach client to epoll: %m");
+		close(fd);
+		return;
+	}
+	attach_clients[i] = fd;
+}
+
+/* watch_container_stdin starts or stops waiting for stdin to be writable. */
+static void watch_container_stdin(int epfd, bool watch)
+{
+	struct epoll_event ev = { .events = EPOLLOUT, .data.fd = container_stdin_fd };
+
+	if (watch == stdin_watched)
+		return;
+	stdin_watched = watch;
+	if (container_stdin_is_pipe) {
+		epoll_ctl(epfd, watch ? EPOLL_CTL_ADD : EPOLL_CTL_DEL, container_stdin_fd, &ev);
+		return;
+	}
+	/* the master pty is also watched for the output */
+	ev.events = watch ? EPOLLIN | EPOLLOUT : EPOLLIN;
+	epoll_ctl(epfd, EPOLL_CTL_MOD, container_stdin_fd, &ev);
+}
+
+/*
+ * close_container_stdin stops passing input to the container, once the
+ * pending input is flushed. The master pty also carries the output of the
+ * container, so it is left open and the end of the input is typed instead.
+ */
+static void close_container_stdin(int epfd)
+{
+	struct termios t;
+
+	if (container_stdin_fd < 0)
+		return;
+	if (stdin_buf->len > 0) {
+		stdin_close_pending = true;
+		return;
+	}
+	stdin_close_pending = false;
+	watch_container_stdin(epfd, false);
+	if (container_stdin_is_pipe) {
+		closep(&container_stdin_fd);
+		return;
+	}
+	if (tcgetattr(container_stdin_fd, &t) == 0 &&
+	    write_all(container_stdin_fd, &t.c_cc[VEOF], 1) < 0)
+		nwarn("Failed to write EOF to the terminal: %m");
+	container_stdin_fd = -1;
+}
+
+/*
+ * flush_container_stdin passes the pending input to the container, as much
+ * of it as the container takes without blocking.
+ */
+static void flush_container_stdin(int epfd)
+{
+	ssize_t res;
+
+	while (stdin_buf->len > 0) {
+		res = write(container_stdin_fd, stdin_buf->str, stdin_buf->len);
+		if (res < 0 && errno == EINTR)
+			continue;
+		if (res < 0 && errno == EAGAIN)
+			break;
+		if (res < 0) {
+			nwarn("Failed to write to the stdin of the container: %m");
+			g_string_truncate(stdin_buf, 0);
+			close_container_stdin(epfd);
+			return;
+		}
+		g_string_erase(stdin_buf, 0, res);
+	}
+	watch_container_stdin(epfd, stdin_buf->len > 0);
+	if (stdin_buf->len == 0 && stdin_close_pending)
+		close_container_stdin(epfd);
+}
+
+/* write_container_stdin queues input for the container. */
+static void write_container_stdin(int epfd, const char *buf, size_t len)
+{
+	if (container_stdin_fd < 0 || stdin_close_pending)
+		return;
+	if (stdin_buf->len + len > STDIN_BUF_MAX) {
+		if (!stdin_dropping)
+			nwarn("The container does not read its stdin, dropping input");
+		stdin_dropping = true;
+		return;
+	}
+	stdin_dropping = false;
+	g_string_append_len(stdin_buf, buf, len);
+	flush_container_stdin(epfd);
+}
+
+/*
+ * remove_attach_client disconnects the client at index i. With stdin_once,
+ * the first client attached to stdin closes it when it goes away, however
+ * it does.
+ */
+static void remove_attach_client(int epfd, int i)
+{
+	epoll_ctl(epfd, EPOLL_CTL_DEL, attach_clients[i], NULL);
+	closep(&attach_clients[i]);
+	if (attach_client_stdin[i] && stdin_once)
+		close_container_stdin(epfd);
+	attach_client_stdin[i] = false;
+}
+
+/*
+ * write_attach_clients sends output of the container to the attached
+ * clients. Clients which cannot keep up are disconnected rather than
+ * blocking the container.
+ */
+static void write_attach_clients(int epfd, int kind, const char *buf, ssize_t buflen)
+{
+	char msg[BUF_SIZE + 1];
+
+	msg[0] = kind;
+	memcpy(msg + 1, buf, buflen);
+	for (int i = 0; i < MAX_ATTACH_CLIENTS; i++) {
+		if (attach_clients[i] < 0)
+			continue;
+		if (send(attach_clients[i], msg, buflen + 1, MSG_DONTWAIT | MSG_NOSIGNAL) < 0) {
+			nwarn("Dropping attach client: %m");
+			remove_attach_client(epfd, i);
+		}
+	}
+}
+
+/*
+ * resize_terminal sets the size of the terminal of the container from a
+ * "<height> <width>" resize message.
+ */
+static void resize_terminal(const char *msg, ssize_t len)
+{
+	char size[32];
+	struct winsize ws = { 0 };
+
+	if (container_terminal_fd < 0 || len >= (ssize_t)sizeof(size))
+		return;
+	memcpy(size, msg, len);
+	size[len] = '\0';
+	if (sscanf(size, "%hu %hu", &ws.ws_row, &ws.ws_col) != 2) {
+		nwarn("Invalid resize message %s", size);
+		return;
+	}
+	if (ioctl(container_terminal_fd, TIOCSWINSZ, &ws) < 0)
+		nwarn("Failed to resize the terminal: %m");
+}
+
+/* handle_attach_client processes a message sent by the client at index i. */
+static void handle_attach_client(int epfd, int i)
+{
+	char msg[BUF_SIZE + 1];
+	ssize_t num_read;
+
+	num_read = recv(attach_clients[i], msg, sizeof(msg), 0);
+	if (num_read < 0 && errno == EINTR)
+		return;
+	if (num_read <= 0) {
+		remove_attach_client(epfd, i);
+		return;
+	}
+
+	switch (msg[0]) {
+	case ATTACH_MSG_STDIN:
+		/* clients attach to stdin with a first, possibly empty, message */
+		attach_client_stdin[i] = true;
+		if (num_read > 1)
+			write_container_stdin(epfd, msg + 1, num_read - 1);
+		break;
+	case ATTACH_MSG_CLOSE_STDIN:
+		if (stdin_once)
+			close_container_stdin(epfd);
+		break;
+	case ATTACH_MSG_RESIZE:
+		resize_terminal(msg + 1, num_read - 1);
+		break;
+	default:
+		nwarn("Unknown attach message %d", msg[0]);
+	}
+}
+
+/*
+ * The OOM killer is watched while the container runs, as its cgroup may
+ * be gone by the time it exits. With cgroup v2, oom_fd is memory.events,
+ * which is polled for changes of its oom_kill counter. With cgroup v1, it
+ * is an eventfd notified through cgroup.event_control.
+ */
+static int oom_fd = -1;
+static bool oom_unified = false;
+static unsigned long long oom_kills = 0;
+static bool oom_killed = false;
+
+/*
+ * memory_cgroup_dir returns the directory of the memory cgroup of pid,
+ * setting unified when it is a cgroup v2 one.
+ */
+static char *memory_cgroup_dir(int pid, bool *unified)
+{
+	_cleanup_free_ char *proc_path = NULL;
+	_cleanup_free_ char *line = NULL;
+	_cleanup_free_ char *unified_path = NULL;
+	char *dir = NULL;
+	size_t len = 0;
+	FILE *f;
+
+	if (asprintf(&proc_path, "/proc/%d/cgroup", pid) < 0)
+		return NULL;
+	f = fopen(proc_path, "re");
+	if (f == NULL)
+		return NULL;
+	while (getline(&line, &len, f) > 0) {
+		/* hierarchy-ID:controller-list:cgroup-path */
+		char *controllers = strchr(line, ':');
+		char *path;
+		char *saveptr = NULL;
+
+		if (controllers == NULL)
+			continue;
+		controllers++;
+		path = strchr(controllers, ':');
+		if (path == NULL)
+			continue;
+		*path++ = '\0';
+		path[strcspn(path, "\n")] = '\0';
+		if (*controllers == '\0') {
+			free(unified_path);
+			unified_path = strdup(path);
+			continue;
+		}
+		for (char *c = strtok_r(controllers, ",", &saveptr); c; c = strtok_r(NULL, ",", &saveptr)) {
+			if (strcmp(c, "memory") == 0) {
+				if (asprintf(&dir, "/sys/fs/cgroup/memory%s", path) < 0)
+					dir = NULL;
+				fclose(f);
+				return dir;
+			}
+		}
+	}
+	fclose(f);
+	if (unified_path) {
+		*unified = true;
+		if (asprintf(&dir, "/sys/fs/cgroup%s", unified_path) < 0)
+			dir = NULL;
+	}
+	return dir;
+}
+
+/* stop_oom_watch stops watching the OOM killer, once the cgroup is gone. */
+static void stop_oom_watch(int epfd)
+{
+	epoll_ctl(epfd, EPOLL_CTL_DEL, oom_fd, NULL);
+	closep(&oom_fd);
+}
+
+/*
+ * read_oom_kills reads the oom_kill counter of memory.events, returning -1
+ * once the cgroup is gone.
+ */
+static int read_oom_kills(unsigned long long *kills)
+{
+	char buf[BUF_SIZE];
+	ssize_t num_read;
+	char *saveptr = NULL;
+
+	num_read = pread(oom_fd, buf, sizeof(buf) - 1, 0);
+	if (num_read < 0)
+		return -1;
+	buf[num_read] = '\0';
+	for (char *line = strtok_r(buf, "\n", &saveptr); line; line = strtok_r(NULL, "\n", &saveptr)) {
+		if (sscanf(line, "oom_kill %llu", kills) == 1)
+			return 0;
+	}
+	*kills = 0;
+	return 0;
+}
+
+/* setup_oom_watch starts watching the OOM killer in the cgroup of pid. */
+static void setup_oom_watch(int epfd, int pid)
+{
+	struct epoll_event ev = { .events = EPOLLIN };
+	bool unified = false;
+	_cleanup_free_ char *dir = memory_cgroup_dir(pid, &unified);
+	_cleanup_free_ char *path = NULL;
+
+	if (dir == NULL) {
+		nwarn("Failed to find the memory cgroup of the container");
+		return;
+	}
+
+	if (unified) {
+		if (asprintf(&path, "%s/memory.events", dir) < 0)
+			return;
+		oom_fd = open(path, O_RDONLY | O_CLOEXEC);
+		if (oom_fd < 0) {
+			nwarn("Failed to open %s: %m", path);
+			return;
+		}
+		oom_unified = true;
+		/* the file is reported as changed until it is read */
+		if (read_oom_kills(&oom_kills) < 0) {
+			nwarn("Failed to read %s: %m", path);
+			closep(&oom_fd);
+			return;
+		}
+		ev.events = EPOLLPRI;
+	} else {
+		_cleanup_free_ char *control_path = NULL;
+		_cleanup_free_ char *registration = NULL;
+		_cleanup_close_ int control_fd = -1;
+		_cleanup_close_ int event_control_fd = -1;
+
+		if (asprintf(&control_path, "%s/memory.oom_control", dir) < 0 ||
+		    asprintf(&path, "%s/cgroup.event_control", dir) < 0)
+			return;
+		control_fd = open(control_path, O_RDONLY | O_CLOEXEC);
+		if (control_fd < 0) {
+			nwarn("Failed to open %s: %m", control_path);
+			return;
+		}
+		event_control_fd = open(path, O_WRONLY | O_CLOEXEC);
+		if (event_control_fd < 0) {
+			nwarn("Failed to open %s: %m", path);
+			return;
+		}
+		oom_fd = eventfd(0, EFD_CLOEXEC | EFD_NONBLOCK);
+		if (oom_fd < 0) {
+			nwarn("Failed to create the OOM eventfd: %m");
+			return;
+		}
+		if (asprintf(&registration, "%d %d", oom_fd, control_fd) < 0 ||
+		    write_all(event_control_fd, registration, strlen(registration)) < 0) {
+			nwarn("Failed to register for the OOM events of %s", dir);
+			closep(&oom_fd);
+			return;
+		}
+	}
+
+	ev.data.fd = oom_fd;
+	if (epoll_ctl(epfd, EPOLL_CTL_ADD, oom_fd, &ev) < 0) {
+		nwarn("Failed to add the OOM watch to epoll: %m");
+		closep(&oom_fd);
+	}
+}
+
+/* check_oom records whether the OOM killer killed a process of the container. */
+static void check_oom(int epfd)
+{
+	unsigned long long kills;
+	uint64_t events;
+
+	if (oom_fd < 0)
+		return;
+
+	if (oom_unified) {
+		if (read_oom_kills(&kills) < 0) {
+			stop_oom_watch(epfd);
+			return;
+		}
+		if (kills > oom_kills)
+			oom_killed = true;
+		oom_kills = kills;
+		return;
+	}
+
+	if (read(oom_fd, &events, sizeof(events)) == sizeof(events) && events > 0)
+		oom_killed = true;
+}
 
 int main(int argc, char *argv[])
 {
 	int ret;
-	const char *cid;
-	char cmd[CMD_SIZE];
 	GError *err = NULL;
-	_cleanup_free_ char *contents;
+	GOptionContext *context;
+	_cleanup_free_ char *contents = NULL;
+	_cleanup_free_ char *default_pid_file = NULL;
+	_cleanup_free_ char *default_exit_file = NULL;
+	_cleanup_free_ char *default_oom_file = NULL;
+	_cleanup_free_ char *exit_str = NULL;
+	_cleanup_gstring_ GString *create_err = NULL;
+	GPtrArray *runtime_argv;
 	int cpid = -1;
-	int status;
+	int create_pid;
+	int create_status = -1;
+	int status = -1;
+	bool exited = false;
+	int open_fds = 0;
 	pid_t pid;
+	int sync_fd = -1;
+	const char *sync_pipe;
 	_cleanup_close_ int mfd = -1;
+	_cleanup_close_ int sfd = -1;
 	_cleanup_close_ int epfd = -1;
+	_cleanup_close_ int dev_null = -1;
+	_cleanup_close_ int afd = -1;
+	_cleanup_free_ char *default_attach_socket_path = NULL;
+	int in_pipe[2] = { -1, -1 };
+	int out_pipe[2] = { -1, -1 };
+	int err_pipe[2] = { -1, -1 };
 	char slname[BUF_SIZE];
 	char buf[BUF_SIZE];
-	int num_read;
-	struct termios t;
+	ssize_t num_read;
+	sigset_t mask;
 	struct epoll_event ev;
 	struct epoll_event evlist[MAX_EVENTS];
 
-	if (argc < 2) {
-		nexit("Run as: conmon <id>");
+	context = g_option_context_new("- conmon utility");
+	g_option_context_add_main_entries(context, entries, "conmon");
+	if (!g_option_context_parse(context, &argc, &argv, &err))
+		nexit("option parsing failed: %s", err->message);
+	g_option_context_free(context);
+
+	if (cid == NULL)
+		nexit("Container ID not provided. Use --cid");
+	if (runtime_path == NULL)
+		nexit("Runtime path not provided. Use --runtime");
+	if (bundle_path == NULL)
+		nexit("Bundle path not provided. Use --bundle");
+	if (pid_file == NULL) {
+		if (asprintf(&default_pid_file, "%s/pidfile", bundle_path) < 0)
+			nexit("Failed to generate the pidfile path");
+		pid_file = default_pid_file;
+	}
+	if (exit_file == NULL) {
+		if (asprintf(&default_exit_file, "%s/exit", bundle_path) < 0)
+			nexit("Failed to generate the exit file path");
+		exit_file = default_exit_file;
+	}
+	if (oom_file == NULL) {
+		if (asprintf(&default_oom_file, "%s/oom", bundle_path) < 0)
+			nexit("Failed to generate the OOM file path");
+		oom_file = default_oom_file;
+	}
+	if (attach_socket_path == NULL) {
+		if (asprintf(&default_attach_socket_path, "%s/attach", bundle_path) < 0)
+			nexit("Failed to generate the attach socket path");
+		attach_socket_path = default_attach_socket_path;
 	}
 
-	/* Get the container id */
-	cid = argv[1];
+	/* ocid waits for the pid of the container on the sync pipe */
+	sync_pipe = getenv("_OCI_SYNCPIPE");
+	if (sync_pipe) {
+		errno = 0;
+		sync_fd = strtol(sync_pipe, NULL, 10);
+		if (errno != 0 || sync_fd < 0)
+			pexit("Failed to parse _OCI_SYNCPIPE");
+		fcntl(sync_fd, F_SETFD, FD_CLOEXEC);
+	}
 
 	/*
 	 * Set self as subreaper so we can wait for container process
@@ -90,130 +855,281 @@ int main(int argc, char *argv[])
 		pexit("Failed to set as subreaper");
 	}
 
-	/* Open the master pty */
-	mfd = open("/dev/ptmx", O_RDWR | O_NOCTTY);
-	if (mfd < 0)
-		pexit("Failed to open console master pty");
+	/* Output of the container is discarded when there is no log path */
+	if (log_path) {
+		if (open_log() < 0)
+			pexit("Failed to open log file %s", log_path);
+	}
 
-	/* Grant access to the slave pty */
-	if (grantpt(mfd) == -1)
-		pexit("Failed to grant access to slave pty");
+	dev_null = open("/dev/null", O_RDWR | O_CLOEXEC);
+	if (dev_null < 0)
+		pexit("Failed to open /dev/null");
 
-	/* Unlock the slave pty */
-	if (unlockpt(mfd) == -1) {             /* Unlock slave pty */
-		pexit("Failed to unlock the slave pty");
-	}
+	if (terminal) {
+		/* Open the master pty */
+		mfd = open("/dev/ptmx", O_RDWR | O_NOCTTY | O_CLOEXEC);
+		if (mfd < 0)
+			pexit("Failed to open console master pty");
 
-	/* Get the slave pty name */
-	ret = ptsname_r(mfd, slname, BUF_SIZE);
-	if (ret != 0) {
-		pexit("Failed to get the slave pty name");
+		/* Grant access to the slave pty */
+		if (grantpt(mfd) == -1)
+			pexit("Failed to grant access to slave pty");
+
+		/* Unlock the slave pty */
+		if (unlockpt(mfd) == -1)
+			pexit("Failed to unlock the slave pty");
+
+		/* Get the slave pty name */
+		ret = ptsname_r(mfd, slname, BUF_SIZE);
+		if (ret != 0)
+			pexit("Failed to get the slave pty name");
+		container_terminal_fd = mfd;
+		if (opt_stdin)
+			container_stdin_fd = mfd;
+		if (fcntl(mfd, F_SETFL, O_NONBLOCK) < 0)
+			pexit("Failed to make the console master pty non-blocking");
+	} else {
+		if (opt_stdin) {
+			if (pipe2(in_pipe, O_CLOEXEC) < 0)
+				pexit("Failed to create the stdin pipe");
+			container_stdin_fd = in_pipe[1];
+			container_stdin_is_pipe = true;
+			if (fcntl(in_pipe[1], F_SETFL, O_NONBLOCK) < 0)
+				pexit("Failed to make the stdin pipe non-blocking");
+		}
+		if (pipe2(out_pipe, O_CLOEXEC) < 0)
+			pexit("Failed to create the stdout pipe");
 	}
+	/*
+	 * The runtime reports errors on stderr, which is also the stderr of
+	 * the container when it has no terminal.
+	 */
+	if (pipe2(err_pipe, O_CLOEXEC) < 0)
+		pexit("Failed to create the stderr pipe");
+
+	/* Block SIGCHLD so it can be received on a signalfd */
+	sigemptyset(&mask);
+	sigaddset(&mask, SIGCHLD);
+	if (sigprocmask(SIG_BLOCK, &mask, NULL) < 0)
+		pexit("Failed to block SIGCHLD");
 
 	/* Create the container */
-	snprintf(cmd, CMD_SIZE, "runc create %s --pid-file pidfile --console %s", cid, slname);
-	ret = system(cmd);
-	if (ret != 0) {
-		nexit("Failed to create container");
+	runtime_argv = g_ptr_array_new();
+	g_ptr_array_add(runtime_argv, runtime_path);
+	if (systemd_cgroup)
+		g_ptr_array_add(runtime_argv, "--systemd-cgroup");
+	g_ptr_array_add(runtime_argv, "create");
+	g_ptr_array_add(runtime_argv, "--bundle");
+	g_ptr_array_add(runtime_argv, bundle_path);
+	g_ptr_array_add(runtime_argv, "--pid-file");
+	g_ptr_array_add(runtime_argv, pid_file);
+	if (terminal) {
+		g_ptr_array_add(runtime_argv, "--console");
+		g_ptr_array_add(runtime_argv, slname);
+	}
+	g_ptr_array_add(runtime_argv, cid);
+	g_ptr_array_add(runtime_argv, NULL);
+
+	create_pid = fork();
+	if (create_pid < 0)
+		pexit("Failed to fork the runtime");
+	if (create_pid == 0) {
+		if (dup2(in_pipe[0] >= 0 ? in_pipe[0] : dev_null, STDIN_FILENO) < 0)
+			pexit("Failed to dup over stdin");
+		if (dup2(terminal ? dev_null : out_pipe[1], STDOUT_FILENO) < 0)
+			pexit("Failed to dup over stdout");
+		if (dup2(err_pipe[1], STDERR_FILENO) < 0)
+			pexit("Failed to dup over stderr");
+		if (sigprocmask(SIG_UNBLOCK, &mask, NULL) < 0)
+			pexit("Failed to unblock SIGCHLD");
+		execv(runtime_path, (char **)runtime_argv->pdata);
+		pexit("Failed to exec %s", runtime_path);
+	}
+	g_ptr_array_free(runtime_argv, TRUE);
+
+	/* a container closing its stdin must not kill us */
+	signal(SIGPIPE, SIG_IGN);
+	stdin_buf = g_string_new(NULL);
+
+	/* Only the runtime and the container hold these ends now */
+	closep(&in_pipe[0]);
+	closep(&out_pipe[1]);
+	closep(&err_pipe[1]);
+
+	while ((pid = waitpid(create_pid, &create_status, 0)) < 0 && errno == EINTR)
+		;
+	if (pid < 0)
+		pexit("Failed to wait for the runtime");
+
+	if (!WIFEXITED(create_status) || WEXITSTATUS(create_status) != 0) {
+		_cleanup_free_ char *message = NULL;
+
+		create_err = read_all(err_pipe[0]);
+		if (asprintf(&message, "%s exited with status %d: %s",
+			     runtime_path, exit_code(create_status), create_err->str) < 0)
+			message = NULL;
+		write_sync(sync_fd, -1, message ? message : "runtime create failed");
+		nexit("Failed to create container: %s", create_err->str);
 	}
 
 	/* Read the pid so we can wait for the process to exit */
-	g_file_get_contents("pidfile", &contents, NULL, &err);
+	g_file_get_contents(pid_file, &contents, NULL, &err);
 	if (err) {
-		fprintf(stderr, "Failed to read pidfile: %s\n", err->message);
-		g_error_free(err);
-		exit(1);
+		write_sync(sync_fd, -1, err->message);
+		nexit("Failed to read pidfile: %s", err->message);
 	}
-
 	cpid = atoi(contents);
-	printf("container PID: %d\n", cpid);
 
-	/* Save exiting termios settings */
-	if (tcgetattr(STDIN_FILENO, &tty_orig) == -1)
-		pexit("tcegetattr");
+	/* Clients may attach as soon as ocid knows about the container */
+	afd = setup_attach_socket();
 
-	/* Settings for raw mode */
-	t.c_lflag &= ~(ISIG | ICANON | ECHO | ECHOE | ECHOK | ECHONL | IEXTEN);
-	t.c_iflag &= ~(BRKINT | ICRNL | IGNBRK | IGNCR | INLCR | INPCK |
-		       ISTRIP | IXON | IXOFF | IGNPAR | PARMRK);
-	t.c_oflag &= ~OPOST;
-	t.c_cc[VMIN] = 1;
-	t.c_cc[VTIME] = 0;
+	write_sync(sync_fd, cpid, NULL);
+	closep(&sync_fd);
 
-	/* Set terminal to raw mode */
-	if (tcsetattr(STDIN_FILENO, TCSAFLUSH, &t) == -1)
-		pexit("tcsetattr");
+	sfd = signalfd(-1, &mask, SFD_CLOEXEC);
+	if (sfd < 0)
+		pexit("Failed to create signalfd");
 
-	/* Setup terminal restore on exit */
-	if (atexit(tty_restore) != 0)
-		pexit("atexit");
-
-	epfd = epoll_create(5);
+	epfd = epoll_create1(EPOLL_CLOEXEC);
 	if (epfd < 0)
 		pexit("epoll_create");
 	ev.events = EPOLLIN;
-	ev.data.fd = STDIN_FILENO;
-	if (epoll_ctl(epfd, EPOLL_CTL_ADD, STDIN_FILENO, &ev) < 0) {
-		pexit("Failed to add stdin to epoll");
-	}
-	ev.data.fd = mfd;
-	if (epoll_ctl(epfd, EPOLL_CTL_ADD, mfd, &ev) < 0) {
-		pexit("Failed to add console master fd to epoll");
+	ev.data.fd = sfd;
+	if (epoll_ctl(epfd, EPOLL_CTL_ADD, sfd, &ev) < 0)
+		pexit("Failed to add signalfd to epoll");
+	ev.data.fd = afd;
+	if (epoll_ctl(epfd, EPOLL_CTL_ADD, afd, &ev) < 0)
+		pexit("Failed to add the attach socket to epoll");
+	if (terminal) {
+		ev.data.fd = mfd;
+		if (epoll_ctl(epfd, EPOLL_CTL_ADD, mfd, &ev) < 0)
+			pexit("Failed to add console master fd to epoll");
+		open_fds++;
+	} else {
+		ev.data.fd = out_pipe[0];
+		if (epoll_ctl(epfd, EPOLL_CTL_ADD, out_pipe[0], &ev) < 0)
+			pexit("Failed to add stdout pipe to epoll");
+		ev.data.fd = err_pipe[0];
+		if (epoll_ctl(epfd, EPOLL_CTL_ADD, err_pipe[0], &ev) < 0)
+			pexit("Failed to add stderr pipe to epoll");
+		open_fds += 2;
 	}
+	setup_oom_watch(epfd, cpid);
+
+	/*
+	 * Copy the output of the container to the log file until the
+	 * container process exits and its output is drained.
+	 */
+	while (!exited || open_fds > 0) {
+		int ready = epoll_wait(epfd, evlist, MAX_EVENTS, exited ? 0 : -1);
+		if (ready < 0) {
+			if (errno == EINTR)
+				continue;
+			pexit("epoll_wait");
+		}
+		/* processes left in the container may hold the output open */
+		if (ready == 0)
+			break;
 
-	/* Copy data back and forth between STDIN and master fd */
-	while (true) {
-		int ready = epoll_wait(epfd, evlist, MAX_EVENTS, -1);
 		for (int i = 0; i < ready; i++) {
-			if (evlist[i].events & EPOLLIN) {
-				if (evlist[i].data.fd == STDIN_FILENO) {
-					num_read = read(STDIN_FILENO, buf, BUF_SIZE);
-					if (num_read <= 0)
-						goto out;
-
-					if (write(mfd, buf, num_read) != num_read) {
-						nwarn("partial/failed write (masterFd)");
-						goto out;
-					}
-				} else if (evlist[i].data.fd == mfd) {
-					num_read = read(mfd, buf, BUF_SIZE);
-					if (num_read <= 0)
-						goto out;
-
-					if (write(STDOUT_FILENO, buf, num_read) != num_read) {
-						nwarn("partial/failed write (STDOUT_FILENO)");
-						goto out;
+			int fd = evlist[i].data.fd;
+
+			if (fd == sfd) {
+				struct signalfd_siginfo si;
+				int child_status;
+
+				if (read(sfd, &si, sizeof(si)) != sizeof(si))
+					continue;
+				/* orphans reparented to us are reaped as well */
+				while ((pid = waitpid(-1, &child_status, WNOHANG)) > 0) {
+					if (pid == cpid) {
+						status = child_status;
+						exited = true;
 					}
 				}
-			} else if (evlist[i].events & (EPOLLHUP | EPOLLERR)) {
-				printf("closing fd %d\n", evlist[i].data.fd);
-				if (close(evlist[i].data.fd) < 0)
-					pexit("close");
-				goto out;
+				continue;
 			}
-		}
-	}
-out:
-	tty_restore();
 
-	/* Wait for the container process and record its exit code */
-	while ((pid = waitpid(-1, &status, 0)) > 0) {
-		printf("PID %d exited\n", pid);
-		if (pid == cpid) {
-			_cleanup_free_ char *status_str = NULL;
-			ret = asprintf(&status_str, "%d", status);
-			if (ret < 0) {
-				pexit("Failed to allocate memory for status");
+			if (fd == afd) {
+				accept_attach_client(epfd, afd);
+				continue;
 			}
-			g_file_set_contents("exit", status_str, strlen(status_str), &err);
-			if (err) {
-				fprintf(stderr, "Failed to write %s to exit file: %s\n", status_str, err->message);
-				g_error_free(err);
-				exit(1);
+
+			if (fd == oom_fd) {
+				check_oom(epfd);
+				continue;
+			}
+
+			if (fd == container_stdin_fd && (evlist[i].events & (EPOLLOUT | EPOLLERR))) {
+				flush_container_stdin(epfd);
+				/* the stdin pipe carries no output */
+				if (container_stdin_is_pipe)
+					continue;
+			}
+
+			for (int j = 0; j < MAX_ATTACH_CLIENTS; j++) {
+				if (attach_clients[j] == fd) {
+					handle_attach_client(epfd, j);
+					fd = -1;
+					break;
+				}
+			}
+			if (fd < 0)
+				continue;
+
+			if (evlist[i].events & (EPOLLIN | EPOLLHUP | EPOLLERR)) {
+				/* a terminal merges both streams into stdout */
+				bool is_stderr = fd == err_pipe[0];
+
+				num_read = read(fd, buf, BUF_SIZE);
+				if (num_read > 0) {
+					if (log_fd >= 0 && write_k8s_log(is_stderr ? STDERR_STREAM : STDOUT_STREAM, buf, num_read) < 0)
+						nwarn("Failed to write to the log file");
+					write_attach_clients(epfd, is_stderr ? ATTACH_MSG_STDERR : ATTACH_MSG_STDOUT, buf, num_read);
+					continue;
+				}
+				if (num_read < 0 && (errno == EINTR || errno == EAGAIN))
+					continue;
+
+				/* EOF, or EIO once the slave pty is closed */
+				epoll_ctl(epfd, EPOLL_CTL_DEL, fd, NULL);
+				open_fds--;
 			}
-			break;
 		}
 	}
 
+	/* ocid checks for the OOM file once the exit file is written */
+	check_oom(epfd);
+	if (oom_killed) {
+		g_file_set_contents(oom_file, "", 0, &err);
+		if (err) {
+			nwarn("Failed to write the OOM file: %s", err->message);
+			g_error_free(err);
+			err = NULL;
+		}
+	}
+	closep(&oom_fd);
+
+	/* Record the exit code of the container for ocid */
+	if (asprintf(&exit_str, "%d", exit_code(status)) < 0)
+		pexit("Failed to allocate memory for the exit code");
+	g_file_set_contents(exit_file, exit_str, strlen(exit_str), &err);
+	if (err)
+		nexit("Failed to write %s to exit file: %s", exit_str, err->message);
+
+	/* attached clients see the end of the output */
+	for (int i = 0; i < MAX_ATTACH_CLIENTS; i++) {
+		if (attach_clients[i] >= 0)
+			remove_attach_client(epfd, i);
+	}
+	unlink(attach_socket_path);
+	/* input still pending is lost with the container */
+	g_string_truncate(stdin_buf, 0);
+	close_container_stdin(epfd);
+
+	closep(&log_fd);
+	closep(&out_pipe[0]);
+	closep(&err_pipe[0]);
+
 	return EXIT_SUCCESS;
 }
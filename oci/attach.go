@@ -0,0 +1,115 @@
+package oci
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+)
+
+// attachSocket is the socket in the bundle of a container conmon serves
+// attach clients on.
+const attachSocket = "attach"
+
+// Kinds of the messages exchanged with conmon on the attach socket, see
+// conmon.c.
+const (
+	attachMsgStdout     = 1
+	attachMsgStderr     = 2
+	attachMsgStdin      = 1
+	attachMsgCloseStdin = 2
+	attachMsgResize     = 3
+)
+
+// attachBufSize is the largest payload of a message on the attach socket.
+const attachBufSize = 8192
+
+// AttachConn is a connection to the stdio of a container.
+type AttachConn struct {
+	conn *net.UnixConn
+}
+
+// Attach connects to the stdio of the container c held by its conmon.
+func (r *Runtime) Attach(c *Container) (*AttachConn, error) {
+	addr := &net.UnixAddr{Name: filepath.Join(c.bundlePath, attachSocket), Net: "unixpacket"}
+	conn, err := net.DialUnix("unixpacket", nil, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach to container %s: %v", c.id, err)
+	}
+	return &AttachConn{conn: conn}, nil
+}
+
+// ResizeContainer sets the size of the terminal of the container c.
+func (r *Runtime) ResizeContainer(c *Container, width, height uint16) error {
+	a, err := r.Attach(c)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	return a.Resize(width, height)
+}
+
+// ReadOutput returns the next chunk of output of the container and whether
+// it was written to stderr. It returns io.EOF once the container is gone.
+func (a *AttachConn) ReadOutput() ([]byte, bool, error) {
+	buf := make([]byte, attachBufSize+1)
+	for {
+		n, err := a.conn.Read(buf)
+		if err != nil {
+			return nil, false, err
+		}
+		if n == 0 {
+			return nil, false, io.EOF
+		}
+		switch buf[0] {
+		case attachMsgStdout:
+			return buf[1:n], false, nil
+		case attachMsgStderr:
+			return buf[1:n], true, nil
+		}
+	}
+}
+
+// AttachStdin tells that the client writes to the stdin of the container.
+// For containers created with StdinOnce, stdin is closed once the first
+// such client is gone.
+func (a *AttachConn) AttachStdin() error {
+	return a.send(attachMsgStdin, nil)
+}
+
+// WriteStdin writes p to the stdin of the container. It is dropped if the
+// container does not have stdin open.
+func (a *AttachConn) WriteStdin(p []byte) error {
+	for len(p) > 0 {
+		n := len(p)
+		if n > attachBufSize {
+			n = attachBufSize
+		}
+		if err := a.send(attachMsgStdin, p[:n]); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+// CloseStdin tells that the client is done with stdin, which closes it
+// for containers created with StdinOnce.
+func (a *AttachConn) CloseStdin() error {
+	return a.send(attachMsgCloseStdin, nil)
+}
+
+// Resize sets the size of the terminal of the container, if it has one.
+func (a *AttachConn) Resize(width, height uint16) error {
+	return a.send(attachMsgResize, []byte(fmt.Sprintf("%d %d", height, width)))
+}
+
+func (a *AttachConn) send(kind byte, payload []byte) error {
+	_, err := a.conn.Write(append([]byte{kind}, payload...))
+	return err
+}
+
+// Close detaches from the container.
+func (a *AttachConn) Close() error {
+	return a.conn.Close()
+}
@@ -4,22 +4,33 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/kubernetes-incubator/ocid/utils"
+	pb "github.com/kubernetes/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
 	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/net/context"
 )
 
 // New creates a new Runtime with options provided
-func New(runtimePath string, containerDir string) (*Runtime, error) {
+func New(runtimePath string, conmonPath string, containerDir string, logSizeMax int64, logMaxFiles int) (*Runtime, error) {
 	r := &Runtime{
 		name:         filepath.Base(runtimePath),
 		path:         runtimePath,
+		conmonPath:   conmonPath,
 		containerDir: containerDir,
+		logSizeMax:   logSizeMax,
+		logMaxFiles:  logMaxFiles,
 	}
 	return r, nil
 }
@@ -28,7 +39,13 @@ func New(runtimePath string, containerDir string) (*Runtime, error) {
 type Runtime struct {
 	name         string
 	path         string
+	conmonPath   string
 	containerDir string
+	// logSizeMax is the size container logs are rotated at, they are
+	// not rotated when it is not positive. logMaxFiles rotated files are
+	// kept.
+	logSizeMax  int64
+	logMaxFiles int
 }
 
 // Name returns the name of the OCI Runtime
@@ -66,73 +83,546 @@ func getOCIVersion(name string, args ...string) (string, error) {
 	return v, nil
 }
 
-// CreateContainer creates a container.
+const (
+	// pidFile is the file in the bundle of a container the runtime
+	// writes the pid of its process to.
+	pidFile = "pidfile"
+	// exitFile is the file in the bundle of a container conmon writes
+	// the exit code of its process to.
+	exitFile = "exit"
+	// exitFileTimeout is how long to wait for conmon to write the exit
+	// file once the runtime reports a container as stopped.
+	exitFileTimeout = time.Second
+	// oomFile is the file in the bundle of a container conmon creates,
+	// before the exit file, if the OOM killer killed one of its processes.
+	oomFile = "oom"
+)
+
+// syncInfo is what conmon reports on the sync pipe once the container is
+// created.
+type syncInfo struct {
+	Pid     int    `json:"pid"`
+	Message string `json:"message,omitempty"`
+}
+
+// CreateContainer creates a container. The runtime is run by a conmon
+// process which stays around to capture the output of the container and
+// record its exit code, so that the container can outlive ocid.
 func (r *Runtime) CreateContainer(c *Container) error {
-	return utils.ExecCmdWithStdStreams(os.Stdin, os.Stdout, os.Stderr, r.path, "--systemd-cgroup", "create", "--bundle", c.bundlePath, c.name)
+	terminal, err := processTerminal(c.bundlePath)
+	if err != nil {
+		return err
+	}
+
+	args := []string{
+		"--systemd-cgroup",
+		"-c", c.id,
+		"-r", r.path,
+		"-b", c.bundlePath,
+		"-p", filepath.Join(c.bundlePath, pidFile),
+		"-e", filepath.Join(c.bundlePath, exitFile),
+		"-o", filepath.Join(c.bundlePath, oomFile),
+	}
+	if c.logPath != "" {
+		args = append(args, "-l", c.logPath)
+		if r.logSizeMax > 0 {
+			args = append(args, "--log-size-max", strconv.FormatInt(r.logSizeMax, 10), "--log-max-files", strconv.Itoa(r.logMaxFiles))
+		}
+	}
+	if terminal {
+		args = append(args, "-t")
+	}
+	args = append(args, "-a", filepath.Join(c.bundlePath, attachSocket))
+	if c.stdin {
+		args = append(args, "-i")
+	}
+	if c.stdinOnce {
+		args = append(args, "--stdin-once")
+	}
+
+	parentPipe, childPipe, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer parentPipe.Close()
+
+	cmd := exec.Command(r.conmonPath, args...)
+	cmd.Dir = c.bundlePath
+	// conmon must not get the signals sent to ocid
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	cmd.ExtraFiles = []*os.File{childPipe}
+	cmd.Env = append(os.Environ(), fmt.Sprintf("_OCI_SYNCPIPE=%d", 3))
+
+	err = cmd.Start()
+	childPipe.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start conmon for container %s: %v", c.id, err)
+	}
+	// collect conmon once it exits, unless ocid is restarted before
+	go func() {
+		if code, err := utils.WaitExitCode(cmd); err != nil || code != 0 {
+			logrus.Warnf("conmon of container %s exited with %d: %v", c.id, code, err)
+		}
+	}()
+
+	si := syncInfo{}
+	if err := json.NewDecoder(parentPipe).Decode(&si); err != nil {
+		return fmt.Errorf("failed to get the pid of container %s from conmon: %v", c.id, err)
+	}
+	if si.Pid <= 0 {
+		return fmt.Errorf("failed to create container %s: %s", c.id, strings.TrimSpace(si.Message))
+	}
+	logrus.Debugf("created container %s with pid %d", c.id, si.Pid)
+
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	c.state.Pid = si.Pid
+	return c.save()
+}
+
+// processTerminal returns whether the process of the container in bundle
+// gets a terminal.
+func processTerminal(bundle string) (bool, error) {
+	data, err := ioutil.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		return false, err
+	}
+	spec := specs.Spec{}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return false, fmt.Errorf("failed to parse the spec in %s: %v", bundle, err)
+	}
+	return spec.Process.Terminal, nil
 }
 
 // StartContainer starts a container.
 func (r *Runtime) StartContainer(c *Container) error {
-	return utils.ExecCmdWithStdStreams(os.Stdin, os.Stdout, os.Stderr, r.path, "start", c.name)
+	if err := utils.ExecCmdWithStdStreams(os.Stdin, os.Stdout, os.Stderr, r.path, "start", c.id); err != nil {
+		return err
+	}
+	c.stateLock.Lock()
+	c.state.Started = time.Now()
+	c.stateLock.Unlock()
+	if err := r.UpdateStatus(c); err != nil {
+		return err
+	}
+
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.save()
 }
 
-// StopContainer stops a container.
-func (r *Runtime) StopContainer(c *Container) error {
-	// TODO: Check if it is still running after some time and send SIGKILL
-	return utils.ExecCmdWithStdStreams(os.Stdin, os.Stdout, os.Stderr, r.path, "kill", c.name)
+const (
+	// defaultStopSignal is sent to stop containers whose image does not
+	// define a stop signal.
+	defaultStopSignal = "TERM"
+	// killTimeout is how long to wait for a container to be gone after
+	// sending it SIGKILL.
+	killTimeout = 10 * time.Second
+	// stopPollInterval is how often the state of a container is checked
+	// while waiting for it to stop.
+	stopPollInterval = 100 * time.Millisecond
+)
+
+// StopContainer stops a container. It is sent its stop signal and given
+// timeout to exit, after which it is killed.
+func (r *Runtime) StopContainer(c *Container, timeout time.Duration) error {
+	if err := r.UpdateStatus(c); err != nil {
+		return err
+	}
+	if r.ContainerStatus(c).Status == ContainerStateStopped {
+		return nil
+	}
+
+	signal := c.stopSignal
+	if signal == "" {
+		signal = defaultStopSignal
+	}
+	if timeout > 0 {
+		if err := r.kill(c, signal); err != nil {
+			return err
+		}
+		if r.waitStopped(c, timeout) {
+			return nil
+		}
+		logrus.Infof("container %s did not stop within %v, killing it", c.id, timeout)
+	}
+
+	if err := r.kill(c, "KILL"); err != nil {
+		return err
+	}
+	if !r.waitStopped(c, killTimeout) {
+		return fmt.Errorf("container %s is still running after being killed", c.id)
+	}
+	return nil
+}
+
+// kill sends signal to the container, unless it is already stopped.
+func (r *Runtime) kill(c *Container, signal string) error {
+	if err := utils.ExecCmdWithStdStreams(os.Stdin, os.Stdout, os.Stderr, r.path, "kill", c.id, signal); err != nil {
+		// the container may have exited on its own in the meantime
+		if err1 := r.UpdateStatus(c); err1 == nil && r.ContainerStatus(c).Status == ContainerStateStopped {
+			return nil
+		}
+		return fmt.Errorf("failed to send %s to container %s: %v", signal, c.id, err)
+	}
+	return nil
 }
 
-// DeleteContainer deletes a container.
+// waitStopped polls the state of the container until it is stopped or
+// timeout expires, and returns whether it stopped.
+func (r *Runtime) waitStopped(c *Container, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if err := r.UpdateStatus(c); err != nil {
+			logrus.Warnf("failed to get the state of container %s: %v", c.id, err)
+		} else if r.ContainerStatus(c).Status == ContainerStateStopped {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(stopPollInterval)
+	}
+}
+
+// ExecCmd returns a command that runs cmd inside the container c.
+func (r *Runtime) ExecCmd(c *Container, cmd []string) *exec.Cmd {
+	args := append([]string{"exec", c.id}, cmd...)
+	return exec.Command(r.path, args...)
+}
+
+// ExecSyncResults is the output and exit code of a command run by ExecSync.
+type ExecSyncResults struct {
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int32
+}
+
+// execSyncOutputMax is the most output of each stream ExecSync returns, the
+// rest is discarded.
+const execSyncOutputMax = 1 << 20
+
+// execSyncDrainTimeout is how long the output of a command run by ExecSync
+// is still read once it exited, as processes it left in the background may
+// hold its output open.
+const execSyncDrainTimeout = time.Second
+
+// limitedBuffer keeps the first max bytes written to it.
+type limitedBuffer struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if n := b.max - b.buf.Len(); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		b.buf.Write(p[:n])
+	}
+	return len(p), nil
+}
+
+// ExecSync runs command in the container c and waits for it to exit. When
+// timeout is positive, the command is killed if it is still running after
+// it, as it is when ctx is done.
+func (r *Runtime) ExecSync(ctx context.Context, c *Container, command []string, timeout time.Duration) (*ExecSyncResults, error) {
+	dir, err := ioutil.TempDir("", "ocid-exec")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "pid")
+
+	// the output is read from pipes rather than copied by cmd, so that
+	// reading it can be given up on
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer stdoutR.Close()
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		stdoutW.Close()
+		return nil, err
+	}
+	defer stderrR.Close()
+
+	args := append([]string{"exec", "--pid-file", pidFile, c.id}, command...)
+	cmd := exec.Command(r.path, args...)
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+	// the command and the processes it starts are killed as a group
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err = cmd.Start()
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout := &limitedBuffer{max: execSyncOutputMax}
+	stderr := &limitedBuffer{max: execSyncOutputMax}
+	var copies sync.WaitGroup
+	copies.Add(2)
+	go func() {
+		io.Copy(stdout, stdoutR)
+		copies.Done()
+	}()
+	go func() {
+		io.Copy(stderr, stderrR)
+		copies.Done()
+	}()
+
+	type result struct {
+		exitCode int32
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		exitCode, err := utils.WaitExitCode(cmd)
+		done <- result{exitCode, err}
+	}()
+
+	var deadline <-chan time.Time
+	drain := time.Now().Add(timeout)
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	var res result
+	select {
+	case res = <-done:
+	case <-deadline:
+		err = fmt.Errorf("command %v in container %s timed out after %v", command, c.id, timeout)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		// the process started in the container may have left the group.
+		// The runtime is gone, so the pid file is written by now if the
+		// process was started at all.
+		if data, err := ioutil.ReadFile(pidFile); err == nil {
+			if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+				syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+		stdoutR.SetReadDeadline(time.Now())
+		stderrR.SetReadDeadline(time.Now())
+		copies.Wait()
+		return nil, err
+	}
+
+	// the output is still read up to the timeout, if that comes first
+	if timeout <= 0 || time.Now().Add(execSyncDrainTimeout).Before(drain) {
+		drain = time.Now().Add(execSyncDrainTimeout)
+	}
+	stdoutR.SetReadDeadline(drain)
+	stderrR.SetReadDeadline(drain)
+	copies.Wait()
+	if res.err != nil {
+		return nil, fmt.Errorf("failed to wait for exec in container %s: %v", c.id, res.err)
+	}
+	return &ExecSyncResults{
+		Stdout:   stdout.buf.Bytes(),
+		Stderr:   stderr.buf.Bytes(),
+		ExitCode: res.exitCode,
+	}, nil
+}
+
+// DeleteContainer deletes a container. A container the runtime does not
+// know about, after a reboot for instance, is already deleted.
 func (r *Runtime) DeleteContainer(c *Container) error {
-	return utils.ExecCmdWithStdStreams(os.Stdin, os.Stdout, os.Stderr, r.path, "delete", c.name)
+	out, err := exec.Command(r.path, "delete", c.id).CombinedOutput()
+	if err != nil && !notExist(out) {
+		return fmt.Errorf("failed to delete container %s: %v: %s", c.id, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// notExist returns whether out, the output of a failed runtime command,
+// says that the container does not exist.
+func notExist(out []byte) bool {
+	return bytes.Contains(out, []byte("does not exist"))
 }
 
-// updateStatus refreshes the status of the container.
+// UpdateStatus refreshes the status of the container. A container the
+// runtime does not know about is stopped.
 func (r *Runtime) UpdateStatus(c *Container) error {
-	out, err := exec.Command(r.path, "state", c.name).Output()
+	out, err := exec.Command(r.path, "state", c.id).Output()
 	if err != nil {
-		return fmt.Errorf("error getting container state for %s: %s", c.name, err)
+		if exitErr, ok := err.(*exec.ExitError); ok && notExist(exitErr.Stderr) {
+			c.stateLock.Lock()
+			defer c.stateLock.Unlock()
+			if c.state.Status == ContainerStateStopped && !c.state.Finished.IsZero() {
+				return nil
+			}
+			c.state.Status = ContainerStateStopped
+			if c.state.Finished.IsZero() {
+				r.setExitStatus(c)
+			}
+			if err := c.save(); err != nil {
+				logrus.Warnf("failed to save the state of container %s: %v", c.id, err)
+			}
+			return nil
+		}
+		return fmt.Errorf("error getting container state for %s: %s", c.id, err)
 	}
+
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	pid := c.state.Pid
+	status := c.state.Status
 	stateReader := bytes.NewReader(out)
 	if err := json.NewDecoder(stateReader).Decode(&c.state); err != nil {
-		return fmt.Errorf("failed to decode container status for %s: %s", c.name, err)
+		return fmt.Errorf("failed to decode container status for %s: %s", c.id, err)
+	}
+	if c.state.Pid == 0 {
+		c.state.Pid = pid
+	}
+
+	if c.state.Status == ContainerStateStopped && c.state.Finished.IsZero() {
+		r.setExitStatus(c)
+	}
+	if c.state.Status != status {
+		if err := c.save(); err != nil {
+			logrus.Warnf("failed to save the state of container %s: %v", c.id, err)
+		}
 	}
 	return nil
 }
 
-// ContainerStatus returns the state of a container.
+// setExitStatus records how the process of the stopped container c exited,
+// as written to the exit file by conmon. It must be called with the state
+// lock of c held.
+func (r *Runtime) setExitStatus(c *Container) {
+	code, finished, err := readExitFile(filepath.Join(c.bundlePath, exitFile), exitFileTimeout)
+	if err != nil {
+		// the best we can do is to report when we noticed the
+		// process was gone.
+		logrus.Warnf("failed to get the exit code of container %s: %v", c.id, err)
+		c.state.Finished = time.Now()
+		c.state.ExitCode = -1
+		return
+	}
+	c.state.Finished = finished
+	c.state.ExitCode = code
+	if _, err := os.Stat(filepath.Join(c.bundlePath, oomFile)); err == nil {
+		c.state.OOMKilled = true
+	}
+}
+
+// readExitFile returns the exit code in the exit file at path and when it
+// was written, waiting up to timeout for conmon to write it.
+func readExitFile(path string, timeout time.Duration) (int32, time.Time, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		fi, err := os.Stat(path)
+		if err == nil {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return 0, time.Time{}, err
+			}
+			code, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 32)
+			if err != nil {
+				return 0, time.Time{}, fmt.Errorf("invalid exit file %s: %v", path, err)
+			}
+			return int32(code), fi.ModTime(), nil
+		}
+		if !os.IsNotExist(err) || time.Now().After(deadline) {
+			return 0, time.Time{}, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// ContainerStatus returns a snapshot of the state of a container.
 func (r *Runtime) ContainerStatus(c *Container) *ContainerState {
-	return c.state
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	state := *c.state
+	return &state
 }
 
 // Container respresents a runtime container.
 type Container struct {
-	name       string
-	bundlePath string
-	logPath    string
-	labels     map[string]string
-	sandbox    string
-	state      *ContainerState
+	id          string
+	name        string
+	bundlePath  string
+	logPath     string
+	labels      map[string]string
+	annotations map[string]string
+	image       *pb.ImageSpec
+	imageRef    string
+	metadata    *pb.ContainerMetadata
+	mounts      []*pb.Mount
+	sandbox     string
+	// stopSignal is the signal sent to stop the container, the default
+	// one when empty.
+	stopSignal string
+	// stdin tells whether the stdin of the container is kept open for
+	// clients to attach to, stdinOnce whether it is closed once the first
+	// client is done with it.
+	stdin     bool
+	stdinOnce bool
+	// opLock serializes the operations done on the container.
+	opLock sync.Mutex
+	// stateLock protects state.
+	stateLock sync.Mutex
+	state     *ContainerState
 }
 
-// ContainerStatus represents the status of a container.
+const (
+	// ContainerStateCreated represents the created state of a container
+	ContainerStateCreated = "created"
+	// ContainerStateRunning represents the running state of a container
+	ContainerStateRunning = "running"
+	// ContainerStateStopped represents the stopped state of a container
+	ContainerStateStopped = "stopped"
+)
+
+// ContainerState represents the status of a container.
 type ContainerState struct {
 	specs.State
-	Created time.Time `json:"created"`
+	Created   time.Time `json:"created"`
+	Started   time.Time `json:"started,omitempty"`
+	Finished  time.Time `json:"finished,omitempty"`
+	ExitCode  int32     `json:"exitCode,omitempty"`
+	OOMKilled bool      `json:"oomKilled,omitempty"`
 }
 
 // NewContainer creates a container object.
-func NewContainer(name string, bundlePath string, logPath string, labels map[string]string, sandbox string) (*Container, error) {
+func NewContainer(id string, name string, bundlePath string, logPath string, labels map[string]string, annotations map[string]string, image *pb.ImageSpec, imageRef string, metadata *pb.ContainerMetadata, mounts []*pb.Mount, sandbox string, stopSignal string, stdin bool, stdinOnce bool) (*Container, error) {
 	c := &Container{
-		name:       name,
-		bundlePath: bundlePath,
-		logPath:    logPath,
-		labels:     labels,
-		sandbox:    sandbox,
+		id:          id,
+		name:        name,
+		bundlePath:  bundlePath,
+		logPath:     logPath,
+		labels:      labels,
+		annotations: annotations,
+		image:       image,
+		imageRef:    imageRef,
+		metadata:    metadata,
+		mounts:      mounts,
+		sandbox:     sandbox,
+		stopSignal:  stopSignal,
+		stdin:       stdin,
+		stdinOnce:   stdinOnce,
+		state:       &ContainerState{},
 	}
 	return c, nil
 }
 
+// ID returns the ID of the container, which is also its ID in the OCI
+// runtime.
+func (c *Container) ID() string {
+	return c.id
+}
+
 // Name returns the name of the container.
 func (c *Container) Name() string {
 	return c.name
@@ -153,14 +643,57 @@ func (c *Container) Labels() map[string]string {
 	return c.labels
 }
 
+// Annotations returns the annotations of the container.
+func (c *Container) Annotations() map[string]string {
+	return c.annotations
+}
+
+// Image returns the image spec the container was created from.
+func (c *Container) Image() *pb.ImageSpec {
+	return c.image
+}
+
+// ImageRef returns the reference of the image the container was created from.
+func (c *Container) ImageRef() string {
+	return c.imageRef
+}
+
+// Metadata returns the metadata of the container.
+func (c *Container) Metadata() *pb.ContainerMetadata {
+	return c.metadata
+}
+
+// Mounts returns the mounts requested for the container.
+func (c *Container) Mounts() []*pb.Mount {
+	return c.mounts
+}
+
 // Sandbox returns the sandbox name of the container.
 func (c *Container) Sandbox() string {
 	return c.sandbox
 }
 
+// Stdin returns whether the stdin of the container is kept open.
+func (c *Container) Stdin() bool {
+	return c.stdin
+}
+
+// Lock takes the operation lock of the container, to be held while
+// starting, stopping or removing it.
+func (c *Container) Lock() {
+	c.opLock.Lock()
+}
+
+// Unlock releases the operation lock of the container.
+func (c *Container) Unlock() {
+	c.opLock.Unlock()
+}
+
 // NetNsPath returns the path to the network namespace of the container.
 func (c *Container) NetNsPath() (string, error) {
-	if c.state == nil {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	if c.state.Pid == 0 {
 		return "", fmt.Errorf("container state is not populated")
 	}
 	return fmt.Sprintf("/proc/%d/ns/net", c.state.Pid), nil
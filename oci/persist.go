@@ -0,0 +1,114 @@
+package oci
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	pb "github.com/kubernetes/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
+)
+
+// ContainerFile is the file in the bundle of a container its metadata and
+// last known state are saved to.
+const ContainerFile = "container.json"
+
+// savedContainer is the on-disk form of a Container.
+type savedContainer struct {
+	ID          string                `json:"id"`
+	Name        string                `json:"name"`
+	BundlePath  string                `json:"bundlePath"`
+	LogPath     string                `json:"logPath"`
+	Labels      map[string]string     `json:"labels,omitempty"`
+	Annotations map[string]string     `json:"annotations,omitempty"`
+	Image       *pb.ImageSpec         `json:"image,omitempty"`
+	ImageRef    string                `json:"imageRef,omitempty"`
+	Metadata    *pb.ContainerMetadata `json:"metadata,omitempty"`
+	Mounts      []*pb.Mount           `json:"mounts,omitempty"`
+	Sandbox     string                `json:"sandbox"`
+	StopSignal  string                `json:"stopSignal,omitempty"`
+	Stdin       bool                  `json:"stdin,omitempty"`
+	StdinOnce   bool                  `json:"stdinOnce,omitempty"`
+	State       *ContainerState       `json:"state"`
+}
+
+// save writes the container to its bundle, replacing the previous copy
+// atomically. It must be called with the state lock of c held.
+func (c *Container) save() error {
+	data, err := json.Marshal(&savedContainer{
+		ID:          c.id,
+		Name:        c.name,
+		BundlePath:  c.bundlePath,
+		LogPath:     c.logPath,
+		Labels:      c.labels,
+		Annotations: c.annotations,
+		Image:       c.image,
+		ImageRef:    c.imageRef,
+		Metadata:    c.metadata,
+		Mounts:      c.mounts,
+		Sandbox:     c.sandbox,
+		StopSignal:  c.stopSignal,
+		Stdin:       c.stdin,
+		StdinOnce:   c.stdinOnce,
+		State:       c.state,
+	})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(c.bundlePath, ContainerFile)
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// RestoreContainer loads the container saved in bundlePath and reconciles
+// its state with the runtime. A container the runtime does not know about
+// anymore is marked as exited.
+func (r *Runtime) RestoreContainer(bundlePath string) (*Container, error) {
+	data, err := ioutil.ReadFile(filepath.Join(bundlePath, ContainerFile))
+	if err != nil {
+		return nil, err
+	}
+	sc := savedContainer{}
+	if err := json.Unmarshal(data, &sc); err != nil {
+		return nil, err
+	}
+	if sc.State == nil {
+		sc.State = &ContainerState{}
+	}
+	c := &Container{
+		id:          sc.ID,
+		name:        sc.Name,
+		bundlePath:  sc.BundlePath,
+		logPath:     sc.LogPath,
+		labels:      sc.Labels,
+		annotations: sc.Annotations,
+		image:       sc.Image,
+		imageRef:    sc.ImageRef,
+		metadata:    sc.Metadata,
+		mounts:      sc.Mounts,
+		sandbox:     sc.Sandbox,
+		stopSignal:  sc.StopSignal,
+		stdin:       sc.Stdin,
+		stdinOnce:   sc.StdinOnce,
+		state:       sc.State,
+	}
+
+	if err := r.UpdateStatus(c); err != nil {
+		logrus.Warnf("failed to get the status of container %s: %v", c.id, err)
+		c.stateLock.Lock()
+		defer c.stateLock.Unlock()
+		if c.state.Finished.IsZero() {
+			c.state.Finished = time.Now()
+			c.state.ExitCode = -1
+		}
+		c.state.Status = ContainerStateStopped
+		if err := c.save(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
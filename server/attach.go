@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/kubernetes-incubator/ocid/api"
+	"github.com/kubernetes-incubator/ocid/oci"
+)
+
+// Attach attaches to the stdio of a running container, which conmon holds
+// for as long as the container lives. The first AttachRequest on the stream
+// selects the container, the input of subsequent requests is written to its
+// stdin. The stream ends when the container exits or the client detaches.
+func (s *Server) Attach(stream api.ExtensionService_AttachServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	containerID := req.GetContainerId()
+	if containerID == "" {
+		return fmt.Errorf("ContainerId should not be empty")
+	}
+	c, err := s.lookupContainer(containerID)
+	if err != nil {
+		return err
+	}
+	if req.GetStdin() && !c.Stdin() {
+		return fmt.Errorf("container %s was not created with stdin open", c.ID())
+	}
+	if err := s.runtime.UpdateStatus(c); err != nil {
+		return err
+	}
+	if s.runtime.ContainerStatus(c).Status == oci.ContainerStateStopped {
+		return fmt.Errorf("container %s is not running", c.ID())
+	}
+
+	conn, err := s.runtime.Attach(c)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// unblock the output below once the client is gone
+	go func() {
+		<-stream.Context().Done()
+		conn.Close()
+	}()
+
+	if req.GetStdin() {
+		if err := conn.AttachStdin(); err != nil {
+			return fmt.Errorf("failed to attach to the stdin of container %s: %v", c.ID(), err)
+		}
+		go func() {
+			for {
+				if len(req.GetInput()) > 0 {
+					if err := conn.WriteStdin(req.GetInput()); err != nil {
+						return
+					}
+				}
+				req, err = stream.Recv()
+				if err != nil {
+					if err != io.EOF {
+						logrus.Debugf("attach to container %s: stopped reading stdin: %v", c.ID(), err)
+					}
+					break
+				}
+			}
+			// the client closed its stdin or detached
+			if err := conn.CloseStdin(); err != nil {
+				logrus.Debugf("attach to container %s: failed to close stdin: %v", c.ID(), err)
+			}
+		}()
+	}
+
+	for {
+		data, stderr, err := conn.ReadOutput()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if ctxErr := stream.Context().Err(); ctxErr != nil {
+				return ctxErr
+			}
+			return fmt.Errorf("failed to read the output of container %s: %v", c.ID(), err)
+		}
+		resp := &api.AttachResponse{}
+		if stderr {
+			resp.Stderr = data
+		} else {
+			resp.Stdout = data
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/kubernetes-incubator/ocid/api"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// defaultCgroupParent is the slice the sandboxes without a cgroup parent
+// are placed in, as the runtime would do for their containers.
+const defaultCgroupParent = "system.slice"
+
+// podResources are the compute resources of a pod, in the units of
+// kubernetes: cores for the CPU and bytes for the memory.
+type podResources struct {
+	CPU struct {
+		Limits   float64 `json:"limits"`
+		Requests float64 `json:"requests"`
+	} `json:"cpu"`
+	Memory struct {
+		Limits   float64 `json:"limits"`
+		Requests float64 `json:"requests"`
+	} `json:"memory"`
+}
+
+// parsePodResources returns the resources in the annotations of a sandbox
+// config, or nil if there are none.
+func parsePodResources(annotations map[string]string) (*podResources, error) {
+	data, ok := annotations[api.ResourcesAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	resources := &podResources{}
+	if err := json.Unmarshal([]byte(data), resources); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %v", api.ResourcesAnnotation, err)
+	}
+	return resources, nil
+}
+
+// podCgroup returns the slice of the sandbox id, beneath the slice of
+// cgroupParent. The runtime manages the cgroups with systemd, so the
+// parent is either a slice or a "slice:prefix:name" cgroups path, of
+// which only the slice is kept. A cgroupfs path such as /kubepods/pod1 is
+// converted to the slice at the same place in the hierarchy.
+func podCgroup(cgroupParent, id string) (string, error) {
+	parent := cgroupParent
+	if strings.HasPrefix(parent, "/") {
+		parent = cgroupfsSlice(parent)
+	} else if i := strings.Index(parent, ":"); i >= 0 {
+		parent = parent[:i]
+	}
+	if parent == "" {
+		parent = defaultCgroupParent
+	}
+	if !strings.HasSuffix(parent, ".slice") {
+		return "", fmt.Errorf("cgroup parent %s is not a systemd slice", cgroupParent)
+	}
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	// the name of a slice is the path of its parent, with dashes
+	if parent == "-.slice" {
+		return fmt.Sprintf("pod%s.slice", id), nil
+	}
+	return fmt.Sprintf("%s-pod%s.slice", strings.TrimSuffix(parent, ".slice"), id), nil
+}
+
+// cgroupfsSlice returns the slice of the cgroupfs path p. The name of a
+// slice is the path of its parent with dashes, so the dashes of the path
+// are replaced. A path made of slices already is reduced to its last one.
+func cgroupfsSlice(p string) string {
+	p = path.Clean(p)
+	if p == "/" {
+		return "-.slice"
+	}
+	if base := path.Base(p); strings.HasSuffix(base, ".slice") {
+		return base
+	}
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for i, part := range parts {
+		parts[i] = strings.Replace(part, "-", "_", -1)
+	}
+	return strings.Join(parts, "-") + ".slice"
+}
+
+// containerCgroup returns the cgroups path of the container id of the
+// sandbox whose slice is podCgroup.
+func containerCgroup(podCgroup, id string) string {
+	return fmt.Sprintf("%s:ocid:%s", podCgroup, id)
+}
+
+func systemctl(args ...string) error {
+	out, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// setPodCgroupResources bounds the slice podCgroup, and so all the
+// containers beneath it, to resources.
+func setPodCgroupResources(podCgroup string, resources *rspec.Resources) error {
+	var props []string
+	if cpu := resources.CPU; cpu != nil {
+		if cpu.Quota != nil && cpu.Period != nil {
+			props = append(props, fmt.Sprintf("CPUQuota=%d%%", *cpu.Quota*100/(*cpu.Period)))
+		}
+		if cpu.Shares != nil {
+			props = append(props, fmt.Sprintf("CPUShares=%d", *cpu.Shares))
+		}
+	}
+	if memory := resources.Memory; memory != nil {
+		if memory.Limit != nil {
+			props = append(props, fmt.Sprintf("MemoryLimit=%d", *memory.Limit))
+		}
+		// only enforced on the unified hierarchy
+		if memory.Reservation != nil {
+			props = append(props, fmt.Sprintf("MemoryLow=%d", *memory.Reservation))
+		}
+	}
+	if len(props) == 0 {
+		return nil
+	}
+	return systemctl(append([]string{"set-property", "--runtime", podCgroup}, props...)...)
+}
+
+// removePodCgroup stops the slice podCgroup once its containers are gone,
+// and removes the properties set on it by setPodCgroupResources.
+func removePodCgroup(podCgroup string) error {
+	out, err := exec.Command("systemctl", "show", "-p", "LoadState", podCgroup).Output()
+	if err != nil {
+		return fmt.Errorf("failed to get state of %s: %v", podCgroup, err)
+	}
+	// the slice is only loaded once a container or a property is put in it
+	if strings.TrimSpace(string(out)) == "LoadState=loaded" {
+		if err := systemctl("stop", podCgroup); err != nil {
+			return err
+		}
+	}
+	return systemctl("revert", podCgroup)
+}
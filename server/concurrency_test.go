@@ -0,0 +1,717 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containers/image/docker"
+	"github.com/containers/image/types"
+	"github.com/docker/distribution/digest"
+	"github.com/kubernetes-incubator/ocid/oci"
+	"github.com/kubernetes-incubator/ocid/storage"
+	pb "github.com/kubernetes/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
+	"golang.org/x/net/context"
+)
+
+// fakeConmon stands for conmon: it starts a sleep as the process of the
+// container, reports its pid and writes its exit code once it is gone.
+const fakeConmon = `#!/bin/sh
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-c) id=$2; shift ;;
+	-e) exitfile=$2; shift ;;
+	-r|-b|-p|-o|-l|-a|--log-size-max|--log-max-files) shift ;;
+	esac
+	shift
+done
+state=%s/$id
+mkdir -p "$state"
+sleep 1000 3>&- &
+pid=$!
+echo $pid > "$state/pid"
+echo created > "$state/status"
+echo "{\"pid\":$pid}" >&3
+exec 3>&-
+wait $pid
+echo $? > "$exitfile.tmp" && mv "$exitfile.tmp" "$exitfile"
+`
+
+// fakeRuntime stands for runc, keeping the state of the containers started
+// by fakeConmon.
+const fakeRuntime = `#!/bin/sh
+state=%s/$2
+case "$1" in
+state)
+	[ -d "$state" ] || { echo "container $2 does not exist" >&2; exit 1; }
+	pid=$(cat "$state/pid")
+	status=$(cat "$state/status")
+	kill -0 "$pid" 2>/dev/null || status=stopped
+	echo "{\"ociVersion\":\"1.0.0\",\"id\":\"$2\",\"status\":\"$status\",\"pid\":$pid,\"bundlePath\":\"\"}"
+	;;
+start)
+	[ -d "$state" ] && echo running > "$state/status"
+	;;
+kill)
+	kill -s "$3" "$(cat "$state/pid")"
+	;;
+exec)
+	shift
+	[ "$1" = --pid-file ] && { echo $$ > "$2"; shift 2; }
+	shift
+	exec "$@"
+	;;
+delete)
+	[ -d "$state" ] || { echo "container $2 does not exist" >&2; exit 1; }
+	kill -s KILL "$(cat "$state/pid")" 2>/dev/null
+	rm -rf "$state"
+	;;
+*)
+	exit 1
+	;;
+esac
+`
+
+// fakeIptables stands for iptables, keeping the chains and the rules of
+// the nat table in a file.
+const fakeIptables = `#!/bin/sh
+rules=%s
+[ "$1" = -t ] && shift 2
+[ "$1" = -n ] && shift
+op=$1
+shift
+touch "$rules"
+case "$op" in
+-N)
+	grep -qxF "chain $1" "$rules" && exit 1
+	echo "chain $1" >> "$rules"
+	;;
+-L)
+	grep -qxF "chain $1" "$rules"
+	;;
+-X)
+	grep -vxF "chain $1" "$rules" > "$rules.tmp"
+	mv "$rules.tmp" "$rules"
+	;;
+-A)
+	echo "rule $*" >> "$rules"
+	;;
+-C)
+	grep -qxF "rule $*" "$rules"
+	;;
+-D)
+	grep -vxF "rule $*" "$rules" > "$rules.tmp"
+	mv "$rules.tmp" "$rules"
+	;;
+-F)
+	grep -v "^rule $1 " "$rules" > "$rules.tmp"
+	mv "$rules.tmp" "$rules"
+	;;
+*)
+	exit 1
+	;;
+esac
+`
+
+type fakeNetPlugin struct{}
+
+func (fakeNetPlugin) Name() string { return "fake" }
+
+func (fakeNetPlugin) SetUpPod(netnsPath, namespace, name, containerID string) error { return nil }
+
+func (fakeNetPlugin) TearDownPod(netnsPath, namespace, name, containerID string) error { return nil }
+
+func (fakeNetPlugin) GetContainerNetworkStatus(netnsPath, namespace, name, containerID string) (string, error) {
+	return "10.0.0.2", nil
+}
+
+func (fakeNetPlugin) Status() error { return nil }
+
+// fakeImageSource serves an image made of a single layer.
+type fakeImageSource struct {
+	ref      types.ImageReference
+	manifest []byte
+	blobs    map[string][]byte
+}
+
+func (s *fakeImageSource) Reference() types.ImageReference { return s.ref }
+
+func (s *fakeImageSource) GetManifest([]string) ([]byte, string, error) {
+	return s.manifest, "application/vnd.docker.distribution.manifest.v2+json", nil
+}
+
+func (s *fakeImageSource) GetBlob(d string) (io.ReadCloser, int64, error) {
+	b, ok := s.blobs[d]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown blob %s", d)
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), int64(len(b)), nil
+}
+
+func (s *fakeImageSource) GetSignatures() ([][]byte, error) { return nil, nil }
+
+func (s *fakeImageSource) Delete() error { return fmt.Errorf("not supported") }
+
+func newFakeImageSource(t *testing.T, name string) *fakeImageSource {
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	passwd := []byte("root:x:0:0:root:/root:/bin/sh\n")
+	for _, h := range []*tar.Header{
+		{Name: "etc/", Mode: 0755, Typeflag: tar.TypeDir},
+		{Name: "etc/passwd", Mode: 0644, Size: int64(len(passwd)), Typeflag: tar.TypeReg},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if h.Typeflag == tar.TypeReg {
+			tw.Write(passwd)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layerDigest := digest.FromBytes(layer.Bytes())
+
+	config, err := json.Marshal(map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config":       map[string]interface{}{"Cmd": []string{"sleep"}},
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []string{layerDigest.String()}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDigest := digest.FromBytes(config)
+
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.docker.distribution.manifest.v2+json",
+		"config": map[string]interface{}{
+			"mediaType": "application/vnd.docker.container.image.v1+json",
+			"size":      len(config),
+			"digest":    configDigest.String(),
+		},
+		"layers": []map[string]interface{}{{
+			"mediaType": "application/vnd.docker.image.rootfs.diff.tar",
+			"size":      layer.Len(),
+			"digest":    layerDigest.String(),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := docker.ParseReference("//" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeImageSource{
+		ref:      ref,
+		manifest: manifest,
+		blobs: map[string][]byte{
+			layerDigest.String():  layer.Bytes(),
+			configDigest.String(): config,
+		},
+	}
+}
+
+// newTestServer returns a server running the containers with fake conmon
+// and runtime scripts, with an image whose ID it returns pulled as the
+// pause image. systemctl and iptables are stubbed out, the nat rules are
+// kept in the iptables file of root.
+func newTestServer(t *testing.T, root string) (*Server, string) {
+	bin := filepath.Join(root, "bin")
+	state := filepath.Join(root, "state")
+	for _, d := range []string{bin, state} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scripts := map[string]string{
+		"conmon":    fmt.Sprintf(fakeConmon, state),
+		"runc":      fmt.Sprintf(fakeRuntime, state),
+		"systemctl": "#!/bin/sh\nexit 0\n",
+		"iptables":  fmt.Sprintf(fakeIptables, filepath.Join(root, "iptables")),
+	}
+	for name, script := range scripts {
+		if err := ioutil.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	images, err := storage.New(filepath.Join(root, "images"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const name = "docker.io/ocid/test:latest"
+	if err := images.Pull(name, newFakeImageSource(t, name)); err != nil {
+		t.Fatal(err)
+	}
+	img, err := images.Lookup(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := oci.New(filepath.Join(bin, "runc"), filepath.Join(bin, "conmon"), filepath.Join(root, "containers"), -1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Server{
+		runtime:      r,
+		images:       images,
+		netPlugin:    fakeNetPlugin{},
+		sandboxDir:   filepath.Join(root, "sandboxes"),
+		pauseImage:   img.ID,
+		pauseCommand: "/pause",
+		execSessions: make(map[string]*execSession),
+		state: &serverState{
+			sandboxes:      make(map[string]*sandbox),
+			containers:     make(map[string]*oci.Container),
+			sandboxNames:   make(map[string]string),
+			containerNames: make(map[string]string),
+			hostPorts:      make(map[string][]*hostPort),
+		},
+	}, img.ID
+}
+
+// TestConcurrentLifecycle runs the lifecycle of several sandboxes and of
+// their containers at the same time, with operations racing on the same
+// sandbox and listings going on, to be run with -race.
+func TestConcurrentLifecycle(t *testing.T) {
+	root, err := ioutil.TempDir("", "ocid-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	s, image := newTestServer(t, root)
+	// the listings warn about the containers removed under them
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.ErrorLevel)
+	defer logrus.SetLevel(level)
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", filepath.Join(root, "bin")+":"+path)
+	defer os.Setenv("PATH", path)
+
+	ctx := context.Background()
+	done := make(chan struct{})
+	var listers sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		listers.Add(1)
+		go func() {
+			defer listers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if sandboxes, err := s.ListPodSandbox(ctx, &pb.ListPodSandboxRequest{}); err == nil {
+					for _, sb := range sandboxes.GetItems() {
+						s.PodSandboxStatus(ctx, &pb.PodSandboxStatusRequest{PodSandboxId: sb.Id})
+					}
+				}
+				if containers, err := s.ListContainers(ctx, &pb.ListContainersRequest{}); err == nil {
+					for _, c := range containers.GetContainers() {
+						s.ContainerStatus(ctx, &pb.ContainerStatusRequest{ContainerId: c.Id})
+					}
+				}
+			}
+		}()
+	}
+
+	const sandboxes = 6
+	errs := make(chan error, sandboxes)
+	var workers sync.WaitGroup
+	for i := 0; i < sandboxes; i++ {
+		workers.Add(1)
+		go func(i int) {
+			defer workers.Done()
+			if err := runSandbox(ctx, s, root, image, i); err != nil {
+				errs <- fmt.Errorf("sandbox %d: %v", i, err)
+			}
+		}(i)
+	}
+	workers.Wait()
+	close(done)
+	listers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	s.state.lock.RLock()
+	defer s.state.lock.RUnlock()
+	if n := len(s.state.sandboxes) + len(s.state.sandboxNames); n != 0 {
+		t.Errorf("%d sandboxes or sandbox names left", n)
+	}
+	if n := len(s.state.containers) + len(s.state.containerNames); n != 0 {
+		t.Errorf("%d containers or container names left", n)
+	}
+}
+
+// TestRemoveWhileCreating removes sandboxes by ID prefix while others are
+// being created, so that the removals look at half created sandboxes.
+func TestRemoveWhileCreating(t *testing.T) {
+	root, err := ioutil.TempDir("", "ocid-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	s, _ := newTestServer(t, root)
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.ErrorLevel)
+	defer logrus.SetLevel(level)
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", filepath.Join(root, "bin")+":"+path)
+	defer os.Setenv("PATH", path)
+
+	ctx := context.Background()
+	done := make(chan struct{})
+	var removers sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		removers.Add(1)
+		go func() {
+			defer removers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, prefix := range "0123456789abcdef" {
+					id := string(prefix)
+					s.RemovePodSandbox(ctx, &pb.RemovePodSandboxRequest{PodSandboxId: &id})
+				}
+			}
+		}()
+	}
+
+	var creators sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		creators.Add(1)
+		go func(i int) {
+			defer creators.Done()
+			name := fmt.Sprintf("sandbox%d", i)
+			s.CreatePodSandbox(ctx, &pb.CreatePodSandboxRequest{Config: &pb.PodSandboxConfig{
+				Metadata: &pb.PodSandboxMetadata{
+					Name:      &name,
+					Namespace: sPtr("default"),
+					Uid:       sPtr(name),
+				},
+				LogDirectory: sPtr(filepath.Join(root, "logs", name)),
+			}})
+		}(i)
+	}
+	creators.Wait()
+	close(done)
+	removers.Wait()
+
+	for _, sb := range s.listSandboxes() {
+		if sb.infraContainer == nil || s.getContainer(sb.infraContainer.ID()) == nil {
+			t.Errorf("sandbox %s is listed without its infra container", sb.id)
+		}
+		id := sb.id
+		if _, err := s.RemovePodSandbox(ctx, &pb.RemovePodSandboxRequest{PodSandboxId: &id}); err != nil {
+			t.Error(err)
+		}
+	}
+	s.state.lock.RLock()
+	defer s.state.lock.RUnlock()
+	if n := len(s.state.sandboxes) + len(s.state.sandboxNames); n != 0 {
+		t.Errorf("%d sandboxes or sandbox names left", n)
+	}
+	if n := len(s.state.containers) + len(s.state.containerNames); n != 0 {
+		t.Errorf("%d containers or container names left", n)
+	}
+}
+
+// restartServer returns a server restored from the state s left on disk.
+func restartServer(t *testing.T, s *Server) *Server {
+	restarted := &Server{
+		runtime:      s.runtime,
+		images:       s.images,
+		netPlugin:    s.netPlugin,
+		sandboxDir:   s.sandboxDir,
+		pauseImage:   s.pauseImage,
+		pauseCommand: s.pauseCommand,
+		execSessions: make(map[string]*execSession),
+		state: &serverState{
+			sandboxes:      make(map[string]*sandbox),
+			containers:     make(map[string]*oci.Container),
+			sandboxNames:   make(map[string]string),
+			containerNames: make(map[string]string),
+			hostPorts:      make(map[string][]*hostPort),
+		},
+	}
+	if err := restarted.restore(); err != nil {
+		t.Fatal(err)
+	}
+	return restarted
+}
+
+// TestForgottenContainers checks that the containers the runtime does not
+// know about anymore, as after a reboot, are reported as exited and can be
+// removed.
+func TestForgottenContainers(t *testing.T) {
+	root, err := ioutil.TempDir("", "ocid-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	s, image := newTestServer(t, root)
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.ErrorLevel)
+	defer logrus.SetLevel(level)
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", filepath.Join(root, "bin")+":"+path)
+	defer os.Setenv("PATH", path)
+
+	ctx := context.Background()
+	sbConfig := &pb.PodSandboxConfig{
+		Metadata: &pb.PodSandboxMetadata{
+			Name:      sPtr("forgotten"),
+			Namespace: sPtr("default"),
+			Uid:       sPtr("forgotten"),
+		},
+		LogDirectory: sPtr(filepath.Join(root, "logs")),
+	}
+	sb, err := s.CreatePodSandbox(ctx, &pb.CreatePodSandboxRequest{Config: sbConfig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sbID := sb.GetPodSandboxId()
+	c, err := s.CreateContainer(ctx, &pb.CreateContainerRequest{
+		PodSandboxId: &sbID,
+		Config: &pb.ContainerConfig{
+			Metadata: &pb.ContainerMetadata{Name: sPtr("a")},
+			Image:    &pb.ImageSpec{Image: &image},
+		},
+		SandboxConfig: sbConfig,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := c.GetContainerId()
+	if _, err := s.StartContainer(ctx, &pb.StartContainerRequest{ContainerId: &id}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the runtime forgets the containers along with their processes
+	states, err := filepath.Glob(filepath.Join(root, "state", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, state := range states {
+		data, err := ioutil.ReadFile(filepath.Join(state, "pid"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pid int
+		fmt.Sscan(string(data), &pid)
+		if p, err := os.FindProcess(pid); err == nil {
+			p.Kill()
+		}
+		if err := os.RemoveAll(state); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s = restartServer(t, s)
+	status, err := s.ContainerStatus(ctx, &pb.ContainerStatusRequest{ContainerId: &id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := status.GetStatus().GetState(); state != pb.ContainerState_EXITED {
+		t.Errorf("container is %v, want EXITED", state)
+	}
+	containers, err := s.ListContainers(ctx, &pb.ListContainersRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range containers.GetContainers() {
+		if c.GetState() != pb.ContainerState_EXITED {
+			t.Errorf("container %s is listed as %v, want EXITED", c.GetId(), c.GetState())
+		}
+	}
+	if _, err := s.RemoveContainer(ctx, &pb.RemoveContainerRequest{ContainerId: &id}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.StopPodSandbox(ctx, &pb.StopPodSandboxRequest{PodSandboxId: &sbID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RemovePodSandbox(ctx, &pb.RemovePodSandboxRequest{PodSandboxId: &sbID}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestHostPorts forwards host ports to a sandbox, checks that they cannot
+// be forwarded to another one until it is stopped, and that they survive
+// a restart of the server.
+func TestHostPorts(t *testing.T) {
+	root, err := ioutil.TempDir("", "ocid-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	s, _ := newTestServer(t, root)
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", filepath.Join(root, "bin")+":"+path)
+	defer os.Setenv("PATH", path)
+
+	ctx := context.Background()
+	sandboxConfig := func(name string) *pb.PodSandboxConfig {
+		hostPort, containerPort := int32(4888), int32(80)
+		return &pb.PodSandboxConfig{
+			Metadata: &pb.PodSandboxMetadata{
+				Name:      &name,
+				Namespace: sPtr("default"),
+				Uid:       sPtr(name),
+			},
+			LogDirectory: sPtr(filepath.Join(root, "logs", name)),
+			PortMappings: []*pb.PortMapping{{
+				Name:          sPtr("http"),
+				Protocol:      pb.Protocol_TCP.Enum(),
+				HostPort:      &hostPort,
+				ContainerPort: &containerPort,
+			}},
+		}
+	}
+	rules := func() string {
+		data, err := ioutil.ReadFile(filepath.Join(root, "iptables"))
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	sb, err := s.CreatePodSandbox(ctx, &pb.CreatePodSandboxRequest{Config: sandboxConfig("web")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sbID := sb.GetPodSandboxId()
+	if r := rules(); !strings.Contains(r, "--dport 4888 -j DNAT --to-destination 10.0.0.2:80") {
+		t.Errorf("host port not forwarded, rules:\n%s", r)
+	}
+	status, err := s.PodSandboxStatus(ctx, &pb.PodSandboxStatusRequest{PodSandboxId: &sbID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := status.GetStatus().GetAnnotations()[portMappingsAnnotation]; !strings.Contains(a, `"hostPort":4888`) {
+		t.Errorf("unexpected port mappings annotation %q", a)
+	}
+
+	if _, err := s.CreatePodSandbox(ctx, &pb.CreatePodSandboxRequest{Config: sandboxConfig("other")}); err == nil {
+		t.Fatal("host port forwarded to two sandboxes")
+	}
+
+	// a restarted server still holds the port
+	restarted := restartServer(t, s)
+	if ports := restarted.sandboxHostPorts(sbID); len(ports) != 1 || ports[0].HostPort != 4888 {
+		t.Errorf("host ports %v restored, want 4888", ports)
+	}
+
+	if _, err := s.StopPodSandbox(ctx, &pb.StopPodSandboxRequest{PodSandboxId: &sbID}); err != nil {
+		t.Fatal(err)
+	}
+	if r := rules(); r != "" {
+		t.Errorf("rules left after stopping the sandbox:\n%s", r)
+	}
+	other, err := s.CreatePodSandbox(ctx, &pb.CreatePodSandboxRequest{Config: sandboxConfig("other")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{sbID, other.GetPodSandboxId()} {
+		if _, err := s.RemovePodSandbox(ctx, &pb.RemovePodSandboxRequest{PodSandboxId: &id}); err != nil {
+			t.Error(err)
+		}
+	}
+	if r := rules(); r != "" {
+		t.Errorf("rules left after removing the sandboxes:\n%s", r)
+	}
+}
+
+// runSandbox creates sandbox i with two containers and starts them, then
+// stops the containers, creates a third one and stops the sandbox all at
+// once, before removing the sandbox.
+func runSandbox(ctx context.Context, s *Server, root, image string, i int) error {
+	name := fmt.Sprintf("sandbox%d", i)
+	sbConfig := &pb.PodSandboxConfig{
+		Metadata: &pb.PodSandboxMetadata{
+			Name:      &name,
+			Namespace: sPtr("default"),
+			Uid:       sPtr(name),
+		},
+		LogDirectory: sPtr(filepath.Join(root, "logs", name)),
+	}
+	sb, err := s.CreatePodSandbox(ctx, &pb.CreatePodSandboxRequest{Config: sbConfig})
+	if err != nil {
+		return err
+	}
+	sbID := sb.GetPodSandboxId()
+
+	createContainer := func(name string) (string, error) {
+		c, err := s.CreateContainer(ctx, &pb.CreateContainerRequest{
+			PodSandboxId: &sbID,
+			Config: &pb.ContainerConfig{
+				Metadata: &pb.ContainerMetadata{Name: &name},
+				Image:    &pb.ImageSpec{Image: &image},
+			},
+			SandboxConfig: sbConfig,
+		})
+		if err != nil {
+			return "", err
+		}
+		return c.GetContainerId(), nil
+	}
+
+	var ids []string
+	for _, n := range []string{"a", "b"} {
+		id, err := createContainer(n)
+		if err != nil {
+			return err
+		}
+		if _, err := s.StartContainer(ctx, &pb.StartContainerRequest{ContainerId: &id}); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+
+	// these race with each other, any of them may fail once the sandbox
+	// is stopped
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			s.StopContainer(ctx, &pb.StopContainerRequest{ContainerId: &id, Timeout: int64Ptr(1)})
+		}(id)
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		createContainer("c")
+	}()
+	go func() {
+		defer wg.Done()
+		s.StopPodSandbox(ctx, &pb.StopPodSandboxRequest{PodSandboxId: &sbID})
+	}()
+	wg.Wait()
+
+	if _, err := s.RemoveContainer(ctx, &pb.RemoveContainerRequest{ContainerId: &ids[0]}); err != nil {
+		return err
+	}
+	if _, err := s.StopPodSandbox(ctx, &pb.StopPodSandboxRequest{PodSandboxId: &sbID}); err != nil {
+		return err
+	}
+	_, err = s.RemovePodSandbox(ctx, &pb.RemovePodSandboxRequest{PodSandboxId: &sbID})
+	return err
+}
@@ -13,4 +13,10 @@ const (
 	maxCPUCFSQuota = 1000000
 	// the lower limit of cpu.cfs_quota_us is 1000.
 	minCPUCFSQuota = 1000
+	// the lower limit of cpu.shares is 2.
+	minCPUShares = 2
 )
+
+// infraContainerName is the name of the infra container of the sandboxes,
+// which holds their namespaces.
+const infraContainerName = "POD"
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/stringid"
+	"github.com/kubernetes-incubator/ocid/api"
+	"github.com/kubernetes-incubator/ocid/utils"
+	pb "github.com/kubernetes/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+// execExitCodeKey is the trailer metadata key carrying the exit code of an
+// Exec session.
+const execExitCodeKey = "exit-code"
+
+// execDrainTimeout is how long the output of an Exec session is still read
+// once its process exited.
+const execDrainTimeout = time.Second
+
+// execIDKey is the header metadata key carrying the ID of an Exec session
+// with a terminal, which identifies it to Resize.
+const execIDKey = "exec-id"
+
+// execSession is a running exec session with a terminal.
+type execSession struct {
+	containerID string
+	master      *os.File
+}
+
+func (s *Server) addExecSession(id string, session *execSession) {
+	s.execLock.Lock()
+	s.execSessions[id] = session
+	s.execLock.Unlock()
+}
+
+func (s *Server) removeExecSession(id string) {
+	s.execLock.Lock()
+	delete(s.execSessions, id)
+	s.execLock.Unlock()
+}
+
+// resizeExecSession sets the size of the terminal of the exec session id
+// of the container containerID. The session is held while doing so, so
+// that its terminal is not closed under the resize.
+func (s *Server) resizeExecSession(id, containerID string, width, height uint16) error {
+	s.execLock.Lock()
+	defer s.execLock.Unlock()
+	session := s.execSessions[id]
+	if session == nil || session.containerID != containerID {
+		return fmt.Errorf("no exec session %s in container %s", id, containerID)
+	}
+	if err := utils.SetFileWinsize(session.master, width, height); err != nil {
+		return fmt.Errorf("failed to resize exec session %s: %v", id, err)
+	}
+	return nil
+}
+
+// execStreamWriter forwards the output of an exec'd process to the client.
+type execStreamWriter struct {
+	mu     *sync.Mutex
+	stream pb.RuntimeService_ExecServer
+	stderr bool
+}
+
+func (w *execStreamWriter) Write(p []byte) (int, error) {
+	// the message may be marshalled after Write returns
+	buf := make([]byte, len(p))
+	copy(buf, p)
+	resp := &pb.ExecResponse{}
+	if w.stderr {
+		resp.Stderr = buf
+	} else {
+		resp.Stdout = buf
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.stream.Send(resp); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Exec executes the command in the container.
+// The first ExecRequest on the stream selects the container and the command,
+// stdin of subsequent requests is forwarded to the process. The ID of a
+// session with a terminal is sent in the header metadata, and the exit code
+// of the process in the trailer metadata once the output is drained.
+func (s *Server) Exec(stream pb.RuntimeService_ExecServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	containerID := req.GetContainerId()
+	if containerID == "" {
+		return fmt.Errorf("ContainerId should not be empty")
+	}
+	c, err := s.lookupContainer(containerID)
+	if err != nil {
+		return err
+	}
+	if len(req.GetCmd()) == 0 {
+		return fmt.Errorf("ExecRequest.Cmd should not be empty")
+	}
+
+	tty := req.GetTty()
+	mu := &sync.Mutex{}
+	stdout := &execStreamWriter{mu: mu, stream: stream}
+	stderr := &execStreamWriter{mu: mu, stream: stream, stderr: true}
+
+	cmd := s.runtime.ExecCmd(c, req.GetCmd())
+
+	var (
+		stdin   io.WriteCloser
+		outputs []*os.File
+		copies  sync.WaitGroup
+	)
+	copyOutput := func(w io.Writer, r *os.File) {
+		outputs = append(outputs, r)
+		copies.Add(1)
+		go func() {
+			// reading fails once the writers are gone, with EIO for a
+			// terminal, or on the deadline set once the process exited
+			io.Copy(w, r)
+			copies.Done()
+		}()
+	}
+	if tty {
+		master, slave, err := utils.OpenPty()
+		if err != nil {
+			return err
+		}
+		defer master.Close()
+
+		// the session is removed before the master is closed, Resize does
+		// not use it past that
+		execID := stringid.GenerateRandomID()
+		s.addExecSession(execID, &execSession{containerID: c.ID(), master: master})
+		defer s.removeExecSession(execID)
+		if err := stream.SendHeader(metadata.Pairs(execIDKey, execID)); err != nil {
+			slave.Close()
+			return err
+		}
+
+		cmd.Stdin = slave
+		cmd.Stdout = slave
+		cmd.Stderr = slave
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Setsid:  true,
+			Setctty: true,
+		}
+		err = cmd.Start()
+		slave.Close()
+		if err != nil {
+			return err
+		}
+		stdin = master
+		copyOutput(stdout, master)
+	} else {
+		stdin, err = cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		// the output is read from pipes rather than copied by cmd, so
+		// that reading it can be given up on
+		stdoutR, stdoutW, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		defer stdoutR.Close()
+		stderrR, stderrW, err := os.Pipe()
+		if err != nil {
+			stdoutW.Close()
+			return err
+		}
+		defer stderrR.Close()
+		cmd.Stdout = stdoutW
+		cmd.Stderr = stderrW
+		err = cmd.Start()
+		stdoutW.Close()
+		stderrW.Close()
+		if err != nil {
+			return err
+		}
+		copyOutput(stdout, stdoutR)
+		copyOutput(stderr, stderrR)
+	}
+
+	go func() {
+		if !tty {
+			defer stdin.Close()
+		}
+		for {
+			if len(req.GetStdin()) > 0 {
+				if _, err := stdin.Write(req.GetStdin()); err != nil {
+					return
+				}
+			}
+			req, err = stream.Recv()
+			if err != nil {
+				if err != io.EOF {
+					logrus.Debugf("exec in container %s: stopped reading stdin: %v", c.ID(), err)
+				}
+				return
+			}
+		}
+	}()
+
+	exitCode, err := utils.WaitExitCode(cmd)
+	if err != nil {
+		return fmt.Errorf("failed to wait for exec in container %s: %v", c.ID(), err)
+	}
+	// processes left in the background hold the output open, only the
+	// output already written is waited for
+	drain := time.Now().Add(execDrainTimeout)
+	for _, r := range outputs {
+		if err := r.SetReadDeadline(drain); err != nil {
+			logrus.Warnf("exec in container %s: failed to set a deadline on the output: %v", c.ID(), err)
+		}
+	}
+	copies.Wait()
+
+	stream.SetTrailer(metadata.Pairs(execExitCodeKey, strconv.Itoa(int(exitCode))))
+	return nil
+}
+
+// ExecSync runs a command in a container and returns its output and exit
+// code once it exits. It is killed after the timeout of the request.
+func (s *Server) ExecSync(ctx context.Context, req *api.ExecSyncRequest) (*api.ExecSyncResponse, error) {
+	containerID := req.GetContainerId()
+	if containerID == "" {
+		return nil, fmt.Errorf("ContainerId should not be empty")
+	}
+	c, err := s.lookupContainer(containerID)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.GetCmd()) == 0 {
+		return nil, fmt.Errorf("ExecSyncRequest.Cmd should not be empty")
+	}
+	if req.GetTimeout() < 0 {
+		return nil, fmt.Errorf("ExecSyncRequest.Timeout should not be negative")
+	}
+
+	res, err := s.runtime.ExecSync(ctx, c, req.GetCmd(), time.Duration(req.GetTimeout())*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ExecSyncResponse{
+		Stdout:   res.Stdout,
+		Stderr:   res.Stderr,
+		ExitCode: res.ExitCode,
+	}, nil
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/kubernetes/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+)
+
+// fakeExecStream is the server side of an Exec stream sending a single
+// request.
+type fakeExecStream struct {
+	req            *pb.ExecRequest
+	stdout, stderr bytes.Buffer
+	trailer        metadata.MD
+}
+
+func (s *fakeExecStream) Send(resp *pb.ExecResponse) error {
+	s.stdout.Write(resp.GetStdout())
+	s.stderr.Write(resp.GetStderr())
+	return nil
+}
+
+func (s *fakeExecStream) Recv() (*pb.ExecRequest, error) {
+	if s.req == nil {
+		return nil, io.EOF
+	}
+	req := s.req
+	s.req = nil
+	return req, nil
+}
+
+func (s *fakeExecStream) SendHeader(metadata.MD) error { return nil }
+
+func (s *fakeExecStream) SetTrailer(md metadata.MD) { s.trailer = md }
+
+func (s *fakeExecStream) Context() context.Context { return context.Background() }
+
+func (s *fakeExecStream) SendMsg(interface{}) error { return nil }
+
+func (s *fakeExecStream) RecvMsg(interface{}) error { return nil }
+
+// TestExecBackgroundOutput checks that an Exec session without a terminal
+// ends once its process exited, even though a process it left in the
+// background holds its output open.
+func TestExecBackgroundOutput(t *testing.T) {
+	root, err := ioutil.TempDir("", "ocid-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	s, image := newTestServer(t, root)
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", filepath.Join(root, "bin")+":"+path)
+	defer os.Setenv("PATH", path)
+
+	ctx := context.Background()
+	sbConfig := &pb.PodSandboxConfig{
+		Metadata: &pb.PodSandboxMetadata{
+			Name:      sPtr("exec"),
+			Namespace: sPtr("default"),
+			Uid:       sPtr("exec"),
+		},
+		LogDirectory: sPtr(filepath.Join(root, "logs")),
+	}
+	sb, err := s.CreatePodSandbox(ctx, &pb.CreatePodSandboxRequest{Config: sbConfig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sbID := sb.GetPodSandboxId()
+	defer s.RemovePodSandbox(ctx, &pb.RemovePodSandboxRequest{PodSandboxId: &sbID})
+	c, err := s.CreateContainer(ctx, &pb.CreateContainerRequest{
+		PodSandboxId: &sbID,
+		Config: &pb.ContainerConfig{
+			Metadata: &pb.ContainerMetadata{Name: sPtr("a")},
+			Image:    &pb.ImageSpec{Image: &image},
+		},
+		SandboxConfig: sbConfig,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := c.GetContainerId()
+	if _, err := s.StartContainer(ctx, &pb.StartContainerRequest{ContainerId: &id}); err != nil {
+		t.Fatal(err)
+	}
+
+	stream := &fakeExecStream{req: &pb.ExecRequest{
+		ContainerId: &id,
+		Cmd:         []string{"sh", "-c", "echo out; echo err >&2; sleep 5 & exit 3"},
+	}}
+	start := time.Now()
+	if err := s.Exec(stream); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > execDrainTimeout+2*time.Second {
+		t.Errorf("exec took %v to return", d)
+	}
+	if out := stream.stdout.String(); out != "out\n" {
+		t.Errorf("stdout is %q, want %q", out, "out\n")
+	}
+	if out := stream.stderr.String(); out != "err\n" {
+		t.Errorf("stderr is %q, want %q", out, "err\n")
+	}
+	if code := stream.trailer[execExitCodeKey]; len(code) != 1 || code[0] != "3" {
+		t.Errorf("exit code is %v, want 3", code)
+	}
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	pb "github.com/kubernetes/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
+)
+
+// portMappingsAnnotation is the annotation of the status of a sandbox
+// listing its active host port mappings, which the runtime API has no
+// field for.
+const portMappingsAnnotation = "ocid/port-mappings"
+
+// hostPort is a port of the host forwarded to a port of a sandbox.
+type hostPort struct {
+	Protocol      string `json:"protocol"`
+	HostIP        string `json:"hostIP,omitempty"`
+	HostPort      int32  `json:"hostPort"`
+	ContainerPort int32  `json:"containerPort"`
+}
+
+func (p *hostPort) String() string {
+	ip := p.HostIP
+	if ip == "" {
+		ip = "0.0.0.0"
+	}
+	return fmt.Sprintf("%s/%s:%d", p.Protocol, ip, p.HostPort)
+}
+
+// conflicts returns whether p and o cannot be forwarded at the same time.
+func (p *hostPort) conflicts(o *hostPort) bool {
+	return p.Protocol == o.Protocol && p.HostPort == o.HostPort &&
+		(p.HostIP == "" || o.HostIP == "" || p.HostIP == o.HostIP)
+}
+
+// parsePortMappings returns the host ports to forward for mappings.
+// Mappings without a host port only document the ports of the sandbox.
+func parsePortMappings(mappings []*pb.PortMapping) ([]*hostPort, error) {
+	var ports []*hostPort
+	for _, m := range mappings {
+		if m.GetHostPort() == 0 {
+			continue
+		}
+		p := &hostPort{
+			HostPort:      m.GetHostPort(),
+			ContainerPort: m.GetContainerPort(),
+		}
+		switch m.GetProtocol() {
+		case pb.Protocol_TCP:
+			p.Protocol = "tcp"
+		case pb.Protocol_UDP:
+			p.Protocol = "udp"
+		default:
+			return nil, fmt.Errorf("unsupported protocol %d for port mapping %s", m.GetProtocol(), m.GetName())
+		}
+		if p.HostPort < 0 || p.HostPort > 65535 || p.ContainerPort <= 0 || p.ContainerPort > 65535 {
+			return nil, fmt.Errorf("invalid ports %d:%d for port mapping %s", p.HostPort, p.ContainerPort, m.GetName())
+		}
+		if hostIP := m.GetHostIp(); hostIP != "" {
+			ip := net.ParseIP(hostIP)
+			if ip == nil || ip.To4() == nil {
+				return nil, fmt.Errorf("invalid host IP %s for port mapping %s, only IPv4 is supported", hostIP, m.GetName())
+			}
+			if !ip.IsUnspecified() {
+				p.HostIP = ip.String()
+			}
+		}
+		for _, o := range ports {
+			if p.conflicts(o) {
+				return nil, fmt.Errorf("host port %s is mapped more than once", p)
+			}
+		}
+		ports = append(ports, p)
+	}
+	return ports, nil
+}
+
+// reserveHostPorts reserves ports for the sandbox id. It fails if any of
+// them is already forwarded to another sandbox.
+func (s *Server) reserveHostPorts(id string, ports []*hostPort) error {
+	s.state.lock.Lock()
+	defer s.state.lock.Unlock()
+	for holder, reserved := range s.state.hostPorts {
+		if holder == id {
+			continue
+		}
+		for _, p := range ports {
+			for _, o := range reserved {
+				if p.conflicts(o) {
+					return fmt.Errorf("host port %s is already used by sandbox %s", p, holder)
+				}
+			}
+		}
+	}
+	if len(ports) > 0 {
+		s.state.hostPorts[id] = ports
+	}
+	return nil
+}
+
+func (s *Server) releaseHostPorts(id string) {
+	s.state.lock.Lock()
+	delete(s.state.hostPorts, id)
+	s.state.lock.Unlock()
+}
+
+// sandboxHostPorts returns the host ports forwarded to the sandbox id.
+func (s *Server) sandboxHostPorts(id string) []*hostPort {
+	s.state.lock.RLock()
+	defer s.state.lock.RUnlock()
+	return s.state.hostPorts[id]
+}
+
+// hostPortChain returns the nat chain holding the rules forwarding the
+// host ports of the sandbox id.
+func hostPortChain(id string) string {
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return "OCID-HP-" + strings.ToUpper(id)
+}
+
+// hostPortJumpArgs are the arguments of the rules sending the traffic to
+// local addresses through chain, for both incoming and locally originated
+// traffic.
+func hostPortJumpArgs(chain string) [][]string {
+	var args [][]string
+	for _, parent := range []string{"PREROUTING", "OUTPUT"} {
+		args = append(args, []string{parent, "-m", "addrtype", "--dst-type", "LOCAL", "-j", chain})
+	}
+	return args
+}
+
+func iptables(args ...string) error {
+	out, err := exec.Command("iptables", append([]string{"-t", "nat"}, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// setupHostPorts forwards ports to podIP, the address of the sandbox id.
+func setupHostPorts(id, podIP string, ports []*hostPort) (err error) {
+	if len(ports) == 0 {
+		return nil
+	}
+	chain := hostPortChain(id)
+	// the chain may be left over from a sandbox which was not torn down
+	if err := teardownHostPorts(id); err != nil {
+		return err
+	}
+	if err := iptables("-N", chain); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if err1 := teardownHostPorts(id); err1 != nil {
+				logrus.Warnf("failed to clean up host ports of sandbox %s: %v", id, err1)
+			}
+		}
+	}()
+
+	for _, p := range ports {
+		args := []string{"-A", chain, "-p", p.Protocol}
+		if p.HostIP != "" {
+			args = append(args, "-d", p.HostIP)
+		}
+		args = append(args, "--dport", strconv.Itoa(int(p.HostPort)),
+			"-j", "DNAT", "--to-destination", net.JoinHostPort(podIP, strconv.Itoa(int(p.ContainerPort))))
+		if err := iptables(args...); err != nil {
+			return err
+		}
+	}
+	for _, args := range hostPortJumpArgs(chain) {
+		if err := iptables(append([]string{"-A"}, args...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// teardownHostPorts stops forwarding the host ports of the sandbox id. It
+// does nothing if they are not forwarded.
+func teardownHostPorts(id string) error {
+	chain := hostPortChain(id)
+	if iptables("-n", "-L", chain) != nil {
+		return nil
+	}
+	for _, args := range hostPortJumpArgs(chain) {
+		// remove every copy of the rule
+		for iptables(append([]string{"-C"}, args...)...) == nil {
+			if err := iptables(append([]string{"-D"}, args...)...); err != nil {
+				return err
+			}
+		}
+	}
+	if err := iptables("-F", chain); err != nil {
+		return err
+	}
+	return iptables("-X", chain)
+}
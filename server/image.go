@@ -1,31 +1,161 @@
 package server
 
 import (
+	"encoding/base64"
 	"errors"
-	"os"
-	"path/filepath"
+	"fmt"
+	"net/url"
+	"strings"
 
-	"github.com/containers/image/directory"
-	"github.com/containers/image/image"
+	"github.com/Sirupsen/logrus"
 	"github.com/containers/image/transports"
+	"github.com/containers/image/types"
+	"github.com/kubernetes-incubator/ocid/storage"
 	pb "github.com/kubernetes/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
 )
 
+func imageToPb(img *storage.Image) *pb.Image {
+	size := img.Size
+	id := img.ID
+	return &pb.Image{
+		Id:          &id,
+		RepoTags:    img.RepoTags,
+		RepoDigests: img.RepoDigests,
+		Size_:       &size,
+	}
+}
+
 // ListImages lists existing images.
 func (s *Server) ListImages(ctx context.Context, req *pb.ListImagesRequest) (*pb.ListImagesResponse, error) {
-	// TODO
-	// containers/storage will take care of this by looking inside /var/lib/ocid/images
-	// and listing images.
-	return nil, nil
+	var images []*storage.Image
+	if name := req.GetFilter().GetImage().GetImage(); name != "" {
+		img, err := s.images.Lookup(name)
+		if err != nil && err != storage.ErrImageUnknown {
+			return nil, err
+		}
+		if img != nil {
+			images = append(images, img)
+		}
+	} else {
+		var err error
+		images, err = s.images.Images()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resp := &pb.ListImagesResponse{
+		Images: []*pb.Image{},
+	}
+	for _, img := range images {
+		resp.Images = append(resp.Images, imageToPb(img))
+	}
+	return resp, nil
 }
 
-// ImageStatus returns the status of the image.
+// ImageStatus returns the status of the image. The returned image is nil
+// if the image is not present in the store.
 func (s *Server) ImageStatus(ctx context.Context, req *pb.ImageStatusRequest) (*pb.ImageStatusResponse, error) {
-	// TODO
-	// containers/storage will take care of this by looking inside /var/lib/ocid/images
-	// and getting the image status
-	return nil, nil
+	name := req.GetImage().GetImage()
+	if name == "" {
+		return nil, errors.New("got empty imagespec name")
+	}
+	img, err := s.images.Lookup(name)
+	if err != nil {
+		if err == storage.ErrImageUnknown {
+			return &pb.ImageStatusResponse{}, nil
+		}
+		return nil, err
+	}
+	return &pb.ImageStatusResponse{
+		Image: imageToPb(img),
+	}, nil
+}
+
+// registryHost returns the canonical name of a registry host, the docker hub
+// being known under several names.
+func registryHost(host string) string {
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+	return host
+}
+
+// authConfig converts the credentials of a pull request for the registry
+// at host. Credentials issued for another registry are not used.
+func authConfig(auth *pb.AuthConfig, host string) (storage.AuthConfig, error) {
+	cfg := storage.AuthConfig{}
+	if addr := auth.GetServerAddress(); addr != "" {
+		if u, err := url.Parse(addr); err == nil && u.Host != "" {
+			addr = u.Host
+		}
+		if registryHost(strings.TrimSuffix(addr, "/")) != registryHost(host) {
+			return cfg, nil
+		}
+	}
+
+	cfg.Username = auth.GetUsername()
+	cfg.Password = auth.GetPassword()
+	if cfg.Username == "" && cfg.Password == "" && auth.GetAuth() != "" {
+		decoded, err := base64.StdEncoding.DecodeString(auth.GetAuth())
+		if err != nil {
+			return cfg, errors.New("failed to decode AuthConfig.Auth")
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return cfg, errors.New("AuthConfig.Auth is not of the form username:password")
+		}
+		cfg.Username = parts[0]
+		cfg.Password = parts[1]
+	}
+	cfg.IdentityToken = auth.GetIdentityToken()
+	cfg.RegistryToken = auth.GetRegistryToken()
+	return cfg, nil
+}
+
+// imageSource returns the source to pull ref from, authenticating with auth
+// when talking to a docker registry.
+func (s *Server) imageSource(ref types.ImageReference, auth *pb.AuthConfig) (types.ImageSource, error) {
+	if auth == nil || ref.Transport().Name() != "docker" {
+		// TODO(runcom): figure out the ImageContext story in containers/image instead of passing ("", true)
+		return ref.NewImageSource("", true)
+	}
+	host := ref.DockerReference().Hostname()
+	cfg, err := authConfig(auth, host)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewRegistrySource(ref, cfg, s.insecureRegistry(host))
+}
+
+// insecureRegistry returns whether the registry at host was configured as
+// reachable over plain http.
+func (s *Server) insecureRegistry(host string) bool {
+	for _, r := range s.insecureRegistries {
+		if registryHost(r) == registryHost(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// pullImage pulls the image named img, with its transport, into the store.
+func (s *Server) pullImage(img string, auth *pb.AuthConfig) error {
+	tr, err := transports.ParseImageName(img)
+	if err != nil {
+		return err
+	}
+	src, err := s.imageSource(tr, auth)
+	if err != nil {
+		return err
+	}
+	if err := s.images.Pull(tr.StringWithinTransport(), src); err != nil {
+		return fmt.Errorf("failed to pull image %s: %v", img, err)
+	}
+	return nil
 }
 
 // PullImage pulls a image with authentication config.
@@ -35,65 +165,131 @@ func (s *Server) PullImage(ctx context.Context, req *pb.PullImageRequest) (*pb.P
 		return nil, errors.New("got empty imagespec name")
 	}
 
-	// TODO(runcom): deal with AuthConfig in req.GetAuth()
-
 	// TODO(mrunalp,runcom): why do we need the SandboxConfig here?
 	// how do we pull in a specified sandbox?
-	tr, err := transports.ParseImageName(img)
-	if err != nil {
+	if err := s.pullImage(img, req.GetAuth()); err != nil {
 		return nil, err
 	}
-	// TODO(runcom): figure out the ImageContext story in containers/image instead of passing ("", true)
-	src, err := tr.NewImageSource("", true)
-	if err != nil {
-		return nil, err
-	}
-	i := image.FromSource(src, nil)
-	blobs, err := i.BlobDigests()
-	if err != nil {
-		return nil, err
+	s.forgetPauseRootfs()
+
+	// TODO: what else do we need here? (Signatures when the story isn't just pulling from docker://)
+
+	return &pb.PullImageResponse{}, nil
+}
+
+// pauseRootfs returns the pause image and the rootfs the infra containers
+// run from, pulling and unpacking the image the first time.
+func (s *Server) pauseRootfs() (*storage.Image, string, error) {
+	s.pause.RLock()
+	img, rootfs := s.pause.img, s.pause.rootfs
+	s.pause.RUnlock()
+	if img != nil {
+		return img, rootfs, nil
 	}
 
-	if err := os.Mkdir(filepath.Join(imageStore, tr.StringWithinTransport()), 0755); err != nil {
-		return nil, err
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+
+	img, err := s.images.Lookup(s.pauseImage)
+	if err == storage.ErrImageUnknown {
+		logrus.Infof("pulling pause image %s", s.pauseImage)
+		if err := s.pullImage(s.pauseImage, nil); err != nil {
+			return nil, "", err
+		}
+		img, err = s.images.Lookup(s.pauseImage)
 	}
-	dir, err := directory.NewReference(filepath.Join(imageStore, tr.StringWithinTransport()))
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	// TODO(runcom): figure out the ImageContext story in containers/image instead of passing ("", true)
-	dest, err := dir.NewImageDestination("", true)
+
+	rootfs, err = s.images.SharedRootfs(img)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	// save blobs (layer + config for docker v2s2, layers only for docker v2s1 [the config is in the manifest])
-	for _, b := range blobs {
-		// TODO(runcom,nalin): we need do-then-commit to later purge on error
-		r, _, err := src.GetBlob(b)
-		if err != nil {
-			return nil, err
-		}
-		if err := dest.PutBlob(b, r); err != nil {
-			r.Close()
-			return nil, err
+	s.pause.Lock()
+	s.pause.img, s.pause.rootfs = img, rootfs
+	s.pause.Unlock()
+	return img, rootfs, nil
+}
+
+// forgetPauseRootfs drops the cached pause image, which may be stale once
+// an image is pulled or removed.
+func (s *Server) forgetPauseRootfs() {
+	s.pause.Lock()
+	s.pause.img, s.pause.rootfs = nil, ""
+	s.pause.Unlock()
+}
+
+// pauseUser returns the ID of a sandbox whose infra container runs from
+// the shared rootfs of img, if any.
+func (s *Server) pauseUser(img *storage.Image) (string, bool) {
+	for _, sb := range s.listSandboxes() {
+		if img.Matches(sb.infraContainer.ImageRef()) {
+			return sb.id, true
 		}
-		r.Close()
 	}
-	// save manifest
-	m, _, err := i.Manifest()
-	if err != nil {
-		return nil, err
-	}
-	if err := dest.PutManifest(m); err != nil {
-		return nil, err
+	// the sandboxes being created have reserved their name but are only
+	// added once their infra container is set
+	if img.Matches(s.pauseImage) {
+		s.state.lock.RLock()
+		defer s.state.lock.RUnlock()
+		for _, id := range s.state.sandboxNames {
+			if _, ok := s.state.sandboxes[id]; !ok {
+				return id, true
+			}
+		}
 	}
+	return "", false
+}
 
-	// TODO: what else do we need here? (Signatures when the story isn't just pulling from docker://)
+// forceRemoveImageKey is the request metadata key which, set to "true",
+// makes RemoveImage remove images still used by containers.
+const forceRemoveImageKey = "ocid-force-remove"
 
-	return &pb.PullImageResponse{}, nil
+// imageUser returns the name of a container created from img, if any.
+func (s *Server) imageUser(img *storage.Image) (string, bool) {
+	for _, c := range s.listContainers() {
+		if img.Matches(c.ImageRef()) {
+			return c.ID(), true
+		}
+	}
+	return "", false
 }
 
 // RemoveImage removes the image.
 func (s *Server) RemoveImage(ctx context.Context, req *pb.RemoveImageRequest) (*pb.RemoveImageResponse, error) {
-	return nil, nil
+	name := req.GetImage().GetImage()
+	if name == "" {
+		return nil, errors.New("got empty imagespec name")
+	}
+	img, err := s.images.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find image %s: %v", name, err)
+	}
+
+	force := false
+	if md, ok := metadata.FromContext(ctx); ok {
+		for _, v := range md[forceRemoveImageKey] {
+			force = force || v == "true"
+		}
+	}
+	// a sandbox reserves its name before it looks the pause rootfs up, so
+	// none can start using it once the cache is dropped under pauseLock
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+	s.forgetPauseRootfs()
+	if !img.HasOtherNames(name) {
+		// even forced, the shared rootfs of the infra containers stays
+		if sb, ok := s.pauseUser(img); ok {
+			return nil, fmt.Errorf("image %s is in use by sandbox %s", name, sb)
+		}
+		if ctr, ok := s.imageUser(img); ok && !force {
+			return nil, fmt.Errorf("image %s is in use by container %s", name, ctr)
+		}
+	}
+
+	if err := s.images.Remove(img, name); err != nil {
+		return nil, fmt.Errorf("failed to remove image %s: %v", name, err)
+	}
+	return &pb.RemoveImageResponse{}, nil
 }
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/chrootarchive"
+	"github.com/kubernetes-incubator/ocid/storage"
+	pb "github.com/kubernetes/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
+	"github.com/opencontainers/ocitools/generate"
+	"github.com/opencontainers/runc/libcontainer/user"
+)
+
+// processArgs merges the command and args of a container with the
+// entrypoint and cmd of its image the way kubernetes does: command replaces
+// the entrypoint and args replace the cmd. When only command is given the
+// cmd of the image is not used.
+func processArgs(config *storage.ImageConfig, command, args []string) ([]string, error) {
+	entrypoint := config.Entrypoint
+	cmd := config.Cmd
+	if len(command) > 0 {
+		entrypoint = command
+		cmd = nil
+	}
+	if len(args) > 0 {
+		cmd = args
+	}
+
+	processArgs := append(append([]string{}, entrypoint...), cmd...)
+	if len(processArgs) == 0 {
+		return nil, fmt.Errorf("no command specified for the container or its image")
+	}
+	return processArgs, nil
+}
+
+// processEnv returns the environment of the image overridden by the
+// variables set for the container.
+func processEnv(config *storage.ImageConfig, envs []*pb.KeyValue) []string {
+	var keys []string
+	values := make(map[string]string)
+	set := func(key, value string) {
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		values[key] = value
+	}
+
+	for _, e := range config.Env {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "")
+		}
+		set(kv[0], kv[1])
+	}
+	for _, e := range envs {
+		if e.GetKey() == "" {
+			continue
+		}
+		set(e.GetKey(), e.GetValue())
+	}
+
+	env := make([]string, 0, len(keys))
+	for _, k := range keys {
+		env = append(env, fmt.Sprintf("%s=%s", k, values[k]))
+	}
+	return env
+}
+
+// rootfsPath returns the path of p inside rootfs, refusing paths going
+// through symbolic links so that the image cannot point us outside of it.
+func rootfsPath(rootfs, p string) (string, error) {
+	path := rootfs
+	for _, c := range strings.Split(filepath.Clean("/"+p), "/") {
+		if c == "" {
+			continue
+		}
+		path = filepath.Join(path, c)
+		fi, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%s is a symbolic link in the container rootfs", p)
+		}
+	}
+	return path, nil
+}
+
+// setImageUser sets the user of the process from the user of the image,
+// looking up names in the passwd and group files of the rootfs.
+func setImageUser(specgen *generate.Generator, rootfs, imageUser string) error {
+	passwd, err := rootfsPath(rootfs, "/etc/passwd")
+	if err != nil {
+		return err
+	}
+	group, err := rootfsPath(rootfs, "/etc/group")
+	if err != nil {
+		return err
+	}
+
+	u, err := user.GetExecUserPath(imageUser, &user.ExecUser{}, passwd, group)
+	if err != nil {
+		return fmt.Errorf("failed to resolve image user %s: %v", imageUser, err)
+	}
+	specgen.SetProcessUID(uint32(u.Uid))
+	specgen.SetProcessGID(uint32(u.Gid))
+	for _, g := range u.Sgids {
+		specgen.AddProcessAdditionalGid(uint32(g))
+	}
+	return nil
+}
+
+// setupImageVolumes bind mounts a directory of the bundle on each volume of
+// the image not already covered by a mount of the container. The content
+// of the image at that path is copied in, as docker does.
+func setupImageVolumes(specgen *generate.Generator, bundle string, volumes map[string]struct{}, mounts []*pb.Mount) error {
+	mounted := make(map[string]bool)
+	for _, m := range mounts {
+		mounted[filepath.Clean(m.GetContainerPath())] = true
+	}
+
+	var paths []string
+	for v := range volumes {
+		paths = append(paths, filepath.Clean("/"+v))
+	}
+	sort.Strings(paths)
+
+	rootfs := filepath.Join(bundle, "rootfs")
+	for _, p := range paths {
+		if mounted[p] {
+			continue
+		}
+		src := filepath.Join(bundle, "volumes", fmt.Sprintf("%x", sha256.Sum256([]byte(p))))
+		if err := os.MkdirAll(src, 0755); err != nil {
+			return err
+		}
+
+		dest, err := rootfsPath(rootfs, p)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Stat(dest); err == nil && fi.IsDir() {
+			if err := chrootarchive.CopyWithTar(dest, src); err != nil {
+				return fmt.Errorf("failed to copy the content of volume %s: %v", p, err)
+			}
+		}
+
+		logrus.Debugf("mounting %s on image volume %s", src, p)
+		specgen.AddBindMount(src, p, "rw")
+	}
+	return nil
+}
+
+// setupImageRootfs applies the parts of the image config which depend on
+// the content of the rootfs of the container in bundle.
+func setupImageRootfs(specgen *generate.Generator, bundle string, config *storage.ImageConfig, mounts []*pb.Mount, setUser bool) error {
+	if setUser && config.User != "" {
+		if err := setImageUser(specgen, filepath.Join(bundle, "rootfs"), config.User); err != nil {
+			return err
+		}
+	}
+	return setupImageVolumes(specgen, bundle, config.Volumes, mounts)
+}
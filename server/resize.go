@@ -0,0 +1,35 @@
+package server
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/kubernetes-incubator/ocid/api"
+	"golang.org/x/net/context"
+)
+
+// Resize sets the size of the terminal of an exec session, or of the
+// container itself for attach sessions.
+func (s *Server) Resize(ctx context.Context, req *api.ResizeRequest) (*api.ResizeResponse, error) {
+	if req.GetWidth() > math.MaxUint16 || req.GetHeight() > math.MaxUint16 {
+		return nil, fmt.Errorf("invalid terminal size %dx%d", req.GetWidth(), req.GetHeight())
+	}
+	width, height := uint16(req.GetWidth()), uint16(req.GetHeight())
+
+	c, err := s.lookupContainer(req.GetContainerId())
+	if err != nil {
+		return nil, err
+	}
+
+	if execID := req.GetExecId(); execID != "" {
+		if err := s.resizeExecSession(execID, c.ID(), width, height); err != nil {
+			return nil, err
+		}
+		return &api.ResizeResponse{}, nil
+	}
+
+	if err := s.runtime.ResizeContainer(c, width, height); err != nil {
+		return nil, err
+	}
+	return &api.ResizeResponse{}, nil
+}
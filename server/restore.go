@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/kubernetes-incubator/ocid/oci"
+	pb "github.com/kubernetes/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
+)
+
+// sandboxFile is the file in the directory of a sandbox its metadata is
+// saved to.
+const sandboxFile = "sandbox.json"
+
+// savedSandbox is the on-disk form of a sandbox.
+type savedSandbox struct {
+	ID           string                 `json:"id"`
+	Name         string                 `json:"name"`
+	Metadata     *pb.PodSandboxMetadata `json:"metadata,omitempty"`
+	LogDir       string                 `json:"logDir"`
+	Labels       map[string]string      `json:"labels,omitempty"`
+	Annotations  map[string]string      `json:"annotations,omitempty"`
+	Created      time.Time              `json:"created"`
+	CgroupParent string                 `json:"cgroupParent"`
+	// HostPorts are the host ports forwarded to the sandbox while it is
+	// running.
+	HostPorts []*hostPort `json:"hostPorts,omitempty"`
+}
+
+// saveSandbox writes the metadata of sb to its directory.
+func (s *Server) saveSandbox(sb *sandbox) error {
+	data, err := json.Marshal(&savedSandbox{
+		ID:           sb.id,
+		Name:         sb.name,
+		Metadata:     sb.metadata,
+		LogDir:       sb.logDir,
+		Labels:       sb.labels,
+		Annotations:  sb.annotations,
+		Created:      sb.created,
+		CgroupParent: sb.cgroupParent,
+		HostPorts:    s.sandboxHostPorts(sb.id),
+	})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.sandboxDir, sb.id, sandboxFile)
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// restore rebuilds the state of the server from the sandbox and container
+// directories, so that the pods created before a restart of ocid can
+// still be managed. Sandboxes and containers which cannot be restored are
+// left alone.
+func (s *Server) restore() error {
+	sandboxDirs, err := ioutil.ReadDir(s.sandboxDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, d := range sandboxDirs {
+		if !d.IsDir() {
+			continue
+		}
+		if err := s.restoreSandbox(filepath.Join(s.sandboxDir, d.Name())); err != nil {
+			logrus.Warnf("failed to restore sandbox %s: %v", d.Name(), err)
+		}
+	}
+
+	containerDirs, err := ioutil.ReadDir(s.runtime.ContainerDir())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, d := range containerDirs {
+		if !d.IsDir() {
+			continue
+		}
+		c, err := s.runtime.RestoreContainer(filepath.Join(s.runtime.ContainerDir(), d.Name()))
+		if err != nil {
+			logrus.Warnf("failed to restore container %s: %v", d.Name(), err)
+			continue
+		}
+		if err := s.reserveName(s.state.containerNames, c.Name(), c.ID()); err != nil {
+			logrus.Warnf("failed to restore container %s: %v", c.ID(), err)
+			continue
+		}
+		if err := s.addContainer(c); err != nil {
+			s.releaseName(s.state.containerNames, c.Name())
+			logrus.Warnf("failed to restore container %s: %v", c.ID(), err)
+		}
+	}
+	logrus.Infof("restored %d sandboxes and %d containers", len(s.state.sandboxes), len(s.state.containers))
+	return nil
+}
+
+// restoreSandbox restores the sandbox saved in dir along with its infra
+// container.
+func (s *Server) restoreSandbox(dir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, sandboxFile))
+	if err != nil {
+		return err
+	}
+	saved := savedSandbox{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	infra, err := s.runtime.RestoreContainer(dir)
+	if err != nil {
+		return fmt.Errorf("failed to restore infra container: %v", err)
+	}
+	if err := s.reserveName(s.state.sandboxNames, saved.Name, saved.ID); err != nil {
+		return err
+	}
+	if err := s.reserveName(s.state.containerNames, infra.Name(), infra.ID()); err != nil {
+		s.releaseName(s.state.sandboxNames, saved.Name)
+		return err
+	}
+	// the rules forwarding the host ports outlive ocid
+	if err := s.reserveHostPorts(saved.ID, saved.HostPorts); err != nil {
+		logrus.Warnf("failed to restore the host ports of sandbox %s: %v", saved.ID, err)
+	}
+	s.addSandbox(&sandbox{
+		id:             saved.ID,
+		name:           saved.Name,
+		metadata:       saved.Metadata,
+		logDir:         saved.LogDir,
+		labels:         saved.Labels,
+		annotations:    saved.Annotations,
+		created:        saved.Created,
+		cgroupParent:   saved.CgroupParent,
+		containers:     make(map[string]*oci.Container),
+		infraContainer: infra,
+	})
+	return nil
+}
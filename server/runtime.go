@@ -1,13 +1,17 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/stringid"
 	"github.com/kubernetes-incubator/ocid/oci"
-	"github.com/kubernetes-incubator/ocid/utils"
+	"github.com/kubernetes-incubator/ocid/storage"
 	pb "github.com/kubernetes/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
 	"github.com/opencontainers/ocitools/generate"
 	"golang.org/x/net/context"
@@ -39,35 +43,70 @@ func (s *Server) Version(ctx context.Context, req *pb.VersionRequest) (*pb.Versi
 
 // CreatePodSandbox creates a pod-level sandbox.
 // The definition of PodSandbox is at https://github.com/kubernetes/kubernetes/pull/25899
-func (s *Server) CreatePodSandbox(ctx context.Context, req *pb.CreatePodSandboxRequest) (*pb.CreatePodSandboxResponse, error) {
-	var err error
-
+func (s *Server) CreatePodSandbox(ctx context.Context, req *pb.CreatePodSandboxRequest) (resp *pb.CreatePodSandboxResponse, err error) {
 	if err := os.MkdirAll(s.sandboxDir, 0755); err != nil {
 		return nil, err
 	}
 
 	// process req.Name
-	name := req.GetConfig().GetMetadata().GetName()
-	if name == "" {
+	metadata := req.GetConfig().GetMetadata()
+	if metadata.GetName() == "" {
 		return nil, fmt.Errorf("PodSandboxConfig.Name should not be empty")
 	}
 
-	podSandboxDir := filepath.Join(s.sandboxDir, name)
-	if _, err := os.Stat(podSandboxDir); err == nil {
-		return nil, fmt.Errorf("pod sandbox (%s) already exists", podSandboxDir)
+	id := stringid.GenerateRandomID()
+	infraID := stringid.GenerateRandomID()
+	name := sandboxName(metadata)
+	if err := s.reserveName(s.state.sandboxNames, name, id); err != nil {
+		return nil, fmt.Errorf("failed to reserve sandbox name %s: %v", name, err)
+	}
+	defer func() {
+		if err != nil {
+			s.releaseName(s.state.sandboxNames, name)
+		}
+	}()
+
+	// the ports of a sandbox in the network namespace of the host are
+	// already host ports
+	hostNetwork := req.GetConfig().GetLinux().GetNamespaceOptions().GetHostNetwork()
+	var hostPorts []*hostPort
+	if !hostNetwork {
+		hostPorts, err = parsePortMappings(req.GetConfig().GetPortMappings())
+		if err != nil {
+			return nil, err
+		}
+		if err := s.reserveHostPorts(id, hostPorts); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				s.releaseHostPorts(id)
+			}
+		}()
+	}
+
+	pauseImage, pauseRootfs, err := s.pauseRootfs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up pause image %s: %v", s.pauseImage, err)
 	}
 
-	if err := os.MkdirAll(podSandboxDir, 0755); err != nil {
+	podSandboxDir := filepath.Join(s.sandboxDir, id)
+	if err := os.Mkdir(podSandboxDir, 0755); err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(podSandboxDir)
+		}
+	}()
 
 	// creates a spec Generator with the default spec.
 	g := generate.New()
 
 	// setup defaults for the pod sandbox
-	g.SetRootPath("/var/lib/ocid/graph/vfs/pause")
+	g.SetRootPath(pauseRootfs)
 	g.SetRootReadonly(true)
-	g.SetProcessArgs([]string{"/pause"})
+	g.SetProcessArgs([]string{s.pauseCommand})
 
 	// process req.Hostname
 	hostname := req.GetConfig().GetHostname()
@@ -78,7 +117,15 @@ func (s *Server) CreatePodSandbox(ctx context.Context, req *pb.CreatePodSandboxR
 	// process req.LogDirectory
 	logDir := req.GetConfig().GetLogDirectory()
 	if logDir == "" {
-		logDir = fmt.Sprintf("/var/log/ocid/pods/%s", name)
+		logDir = fmt.Sprintf("/var/log/ocid/pods/%s", id)
+	}
+	// conmon runs in the bundle of the containers, not in our directory
+	logDir, err = filepath.Abs(logDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(logDir, 0700); err != nil {
+		return nil, err
 	}
 
 	dnsServers := req.GetConfig().GetDnsOptions().GetServers()
@@ -93,26 +140,60 @@ func (s *Server) CreatePodSandbox(ctx context.Context, req *pb.CreatePodSandboxR
 
 	g.AddBindMount(resolvPath, "/etc/resolv.conf", "ro")
 
+	// the containers of the sandbox are placed beneath a slice of its own,
+	// so that the resources of the pod bound all of them
+	cgroupParent, err := podCgroup(req.GetConfig().GetLinux().GetCgroupParent(), id)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			if err1 := removePodCgroup(cgroupParent); err1 != nil {
+				logrus.Warnf("failed to remove cgroup of sandbox %s: %v", id, err1)
+			}
+		}
+	}()
+	annotations := req.GetConfig().GetAnnotations()
+	resources, err := parsePodResources(annotations)
+	if err != nil {
+		return nil, err
+	}
+	if resources != nil {
+		pod := generate.New()
+		if err := setResourcesCPU(resources.CPU.Limits, resources.CPU.Requests, 0, pod); err != nil {
+			return nil, err
+		}
+		if err := setResourcesMemory(resources.Memory.Limits, resources.Memory.Requests, 0, pod); err != nil {
+			return nil, err
+		}
+		if err := setPodCgroupResources(cgroupParent, pod.Spec().Linux.Resources); err != nil {
+			return nil, fmt.Errorf("failed to set resources of sandbox %s: %v", id, err)
+		}
+	}
+	g.SetLinuxCgroupsPath(containerCgroup(cgroupParent, infraID))
+
 	labels := req.GetConfig().GetLabels()
-	s.addSandbox(&sandbox{
-		name:       name,
-		logDir:     logDir,
-		labels:     labels,
-		containers: make(map[string]*oci.Container),
-	})
+	sb := &sandbox{
+		id:           id,
+		name:         name,
+		metadata:     metadata,
+		logDir:       logDir,
+		labels:       labels,
+		annotations:  annotations,
+		created:      time.Now(),
+		cgroupParent: cgroupParent,
+		containers:   make(map[string]*oci.Container),
+	}
+	if err := s.saveSandbox(sb); err != nil {
+		return nil, err
+	}
 
-	annotations := req.GetConfig().GetAnnotations()
 	for k, v := range annotations {
 		g.AddAnnotation(k, v)
 	}
 
-	cgroupParent := req.GetConfig().GetLinux().GetCgroupParent()
-	if cgroupParent != "" {
-		g.SetLinuxCgroupsPath(cgroupParent)
-	}
-
 	// set up namespaces
-	if req.GetConfig().GetLinux().GetNamespaceOptions().GetHostNetwork() {
+	if hostNetwork {
 		err := g.RemoveLinuxNamespace("network")
 		if err != nil {
 			return nil, err
@@ -138,8 +219,17 @@ func (s *Server) CreatePodSandbox(ctx context.Context, req *pb.CreatePodSandboxR
 		return nil, err
 	}
 
-	containerName := name + "-infra"
-	container, err := oci.NewContainer(containerName, podSandboxDir, podSandboxDir, labels, name)
+	infraName := containerName(&pb.ContainerMetadata{Name: sPtr(infraContainerName)}, name)
+	if err := s.reserveName(s.state.containerNames, infraName, infraID); err != nil {
+		return nil, fmt.Errorf("failed to reserve infra container name %s: %v", infraName, err)
+	}
+	defer func() {
+		if err != nil {
+			s.releaseName(s.state.containerNames, infraName)
+		}
+	}()
+
+	container, err := oci.NewContainer(infraID, infraName, podSandboxDir, "", labels, annotations, &pb.ImageSpec{Image: &s.pauseImage}, pauseImage.ID, &pb.ContainerMetadata{Name: sPtr(infraContainerName)}, nil, id, "", false, false)
 	if err != nil {
 		return nil, err
 	}
@@ -147,60 +237,105 @@ func (s *Server) CreatePodSandbox(ctx context.Context, req *pb.CreatePodSandboxR
 	if err := s.runtime.CreateContainer(container); err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			if err1 := s.runtime.StopContainer(container, 0); err1 != nil {
+				logrus.Warnf("failed to stop infra container %s: %v", infraID, err1)
+			}
+			if err1 := s.runtime.DeleteContainer(container); err1 != nil {
+				logrus.Warnf("failed to delete infra container %s: %v", infraID, err1)
+			}
+		}
+	}()
 
 	if err := s.runtime.UpdateStatus(container); err != nil {
 		return nil, err
 	}
 
 	// Setup the network
-	podNamespace := ""
 	netnsPath, err := container.NetNsPath()
 	if err != nil {
 		return nil, err
 	}
-	if err := s.netPlugin.SetUpPod(netnsPath, podNamespace, name, containerName); err != nil {
-		return nil, fmt.Errorf("failed to create network for container %s in sandbox %s: %v", containerName, name, err)
+	if err := s.netPlugin.SetUpPod(netnsPath, metadata.GetNamespace(), metadata.GetName(), infraID); err != nil {
+		return nil, fmt.Errorf("failed to create network for container %s in sandbox %s: %v", infraID, id, err)
+	}
+	defer func() {
+		if err != nil {
+			if err1 := s.netPlugin.TearDownPod(netnsPath, metadata.GetNamespace(), metadata.GetName(), infraID); err1 != nil {
+				logrus.Warnf("failed to destroy network for container %s in sandbox %s: %v", infraID, id, err1)
+			}
+		}
+	}()
+
+	if len(hostPorts) > 0 {
+		var ip string
+		ip, err = s.netPlugin.GetContainerNetworkStatus(netnsPath, metadata.GetNamespace(), metadata.GetName(), infraID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get IP of sandbox %s: %v", id, err)
+		}
+		if err := setupHostPorts(id, ip, hostPorts); err != nil {
+			return nil, fmt.Errorf("failed to forward host ports to sandbox %s: %v", id, err)
+		}
+		defer func() {
+			if err != nil {
+				if err1 := teardownHostPorts(id); err1 != nil {
+					logrus.Warnf("failed to stop forwarding host ports to sandbox %s: %v", id, err1)
+				}
+			}
+		}()
 	}
 
 	if err := s.runtime.StartContainer(container); err != nil {
 		return nil, err
 	}
 
-	s.addContainer(container)
-
 	if err := s.runtime.UpdateStatus(container); err != nil {
 		return nil, err
 	}
 
-	return &pb.CreatePodSandboxResponse{PodSandboxId: &name}, nil
+	// the sandbox is only visible once its infra container is running
+	sb.infraContainer = container
+	s.addSandbox(sb)
+
+	return &pb.CreatePodSandboxResponse{PodSandboxId: &id}, nil
 }
 
 // StopPodSandbox stops the sandbox. If there are any running containers in the
 // sandbox, they should be force terminated.
 func (s *Server) StopPodSandbox(ctx context.Context, req *pb.StopPodSandboxRequest) (*pb.StopPodSandboxResponse, error) {
-	sbName := req.PodSandboxId
-	if *sbName == "" {
+	sbID := req.GetPodSandboxId()
+	if sbID == "" {
 		return nil, fmt.Errorf("PodSandboxId should not be empty")
 	}
-	sb := s.state.sandboxes[*sbName]
-	if sb == nil {
-		return nil, fmt.Errorf("specified sandbox not found: %s", *sbName)
+	sb, unlock, err := s.lockSandbox(sbID, true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := teardownHostPorts(sb.id); err != nil {
+		return nil, fmt.Errorf("failed to stop forwarding host ports to sandbox %s: %v", sb.id, err)
+	}
+	if s.sandboxHostPorts(sb.id) != nil {
+		s.releaseHostPorts(sb.id)
+		if err := s.saveSandbox(sb); err != nil {
+			return nil, err
+		}
 	}
 
-	podInfraContainer := *sbName + "-infra"
-	for _, c := range sb.containers {
-		if podInfraContainer == c.Name() {
-			podNamespace := ""
+	for _, c := range s.sandboxContainers(sb) {
+		if c == sb.infraContainer {
 			netnsPath, err := c.NetNsPath()
 			if err != nil {
 				return nil, err
 			}
-			if err := s.netPlugin.TearDownPod(netnsPath, podNamespace, *sbName, podInfraContainer); err != nil {
-				return nil, fmt.Errorf("failed to destroy network for container %s in sandbox %s: %v", c.Name(), *sbName, err)
+			if err := s.netPlugin.TearDownPod(netnsPath, sb.metadata.GetNamespace(), sb.metadata.GetName(), c.ID()); err != nil {
+				return nil, fmt.Errorf("failed to destroy network for container %s in sandbox %s: %v", c.ID(), sb.id, err)
 			}
 		}
-		if err := s.runtime.StopContainer(c); err != nil {
-			return nil, fmt.Errorf("failed to stop container %s in sandbox %s: %v", c.Name(), *sbName, err)
+		if err := s.runtime.StopContainer(c, 0); err != nil {
+			return nil, fmt.Errorf("failed to stop container %s in sandbox %s: %v", c.ID(), sb.id, err)
 		}
 	}
 
@@ -210,36 +345,53 @@ func (s *Server) StopPodSandbox(ctx context.Context, req *pb.StopPodSandboxReque
 // RemovePodSandbox deletes the sandbox. If there are any running containers in the
 // sandbox, they should be force deleted.
 func (s *Server) RemovePodSandbox(ctx context.Context, req *pb.RemovePodSandboxRequest) (*pb.RemovePodSandboxResponse, error) {
-	sbName := req.PodSandboxId
-	if *sbName == "" {
+	sbID := req.GetPodSandboxId()
+	if sbID == "" {
 		return nil, fmt.Errorf("PodSandboxId should not be empty")
 	}
-	sb := s.state.sandboxes[*sbName]
-	if sb == nil {
-		return nil, fmt.Errorf("specified sandbox not found: %s", *sbName)
+	sb, unlock, err := s.lockSandbox(sbID, true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := teardownHostPorts(sb.id); err != nil {
+		return nil, fmt.Errorf("failed to stop forwarding host ports to sandbox %s: %v", sb.id, err)
 	}
 
-	podInfraContainer := *sbName + "-infra"
+	containers := s.sandboxContainers(sb)
 
 	// Delete all the containers in the sandbox
-	for _, c := range sb.containers {
+	for _, c := range containers {
 		if err := s.runtime.DeleteContainer(c); err != nil {
-			return nil, fmt.Errorf("failed to delete container %s in sandbox %s: %v", c.Name(), *sbName, err)
+			return nil, fmt.Errorf("failed to delete container %s in sandbox %s: %v", c.ID(), sb.id, err)
 		}
-		if podInfraContainer == c.Name() {
+		if c == sb.infraContainer {
 			continue
 		}
-		containerDir := filepath.Join(s.runtime.ContainerDir(), c.Name())
+		containerDir := filepath.Join(s.runtime.ContainerDir(), c.ID())
+		if err := s.images.RemoveRootfs(containerDir); err != nil {
+			return nil, fmt.Errorf("failed to remove container %s rootfs: %v", c.ID(), err)
+		}
 		if err := os.RemoveAll(containerDir); err != nil {
-			return nil, fmt.Errorf("failed to remove container %s directory: %v", c.Name(), err)
+			return nil, fmt.Errorf("failed to remove container %s directory: %v", c.ID(), err)
 		}
 	}
 
+	if err := removePodCgroup(sb.cgroupParent); err != nil {
+		logrus.Warnf("failed to remove cgroup of sandbox %s: %v", sb.id, err)
+	}
+
 	// Remove the files related to the sandbox
-	podSandboxDir := filepath.Join(s.sandboxDir, *sbName)
+	podSandboxDir := filepath.Join(s.sandboxDir, sb.id)
 	if err := os.RemoveAll(podSandboxDir); err != nil {
-		return nil, fmt.Errorf("failed to remove sandbox %s directory: %v", *sbName, err)
+		return nil, fmt.Errorf("failed to remove sandbox %s directory: %v", sb.id, err)
+	}
+
+	for _, c := range containers {
+		s.removeContainer(c)
 	}
+	s.removeSandbox(sb)
 
 	return &pb.RemovePodSandboxResponse{}, nil
 }
@@ -254,58 +406,121 @@ func sPtr(s string) *string {
 
 // PodSandboxStatus returns the Status of the PodSandbox.
 func (s *Server) PodSandboxStatus(ctx context.Context, req *pb.PodSandboxStatusRequest) (*pb.PodSandboxStatusResponse, error) {
-	sbName := req.PodSandboxId
-	if *sbName == "" {
+	sbID := req.GetPodSandboxId()
+	if sbID == "" {
 		return nil, fmt.Errorf("PodSandboxId should not be empty")
 	}
-	sb := s.state.sandboxes[*sbName]
-	if sb == nil {
-		return nil, fmt.Errorf("specified sandbox not found: %s", *sbName)
+	sb, err := s.lookupSandbox(sbID)
+	if err != nil {
+		return nil, err
 	}
 
-	podInfraContainerName := *sbName + "-infra"
-	podInfraContainer := sb.containers[podInfraContainerName]
-
-	cState := s.runtime.ContainerStatus(podInfraContainer)
-	created := cState.Created.Unix()
+	podInfraContainer := sb.infraContainer
+	if podInfraContainer == nil {
+		return nil, fmt.Errorf("infra container of sandbox %s not found", sb.id)
+	}
 
 	netNsPath, err := podInfraContainer.NetNsPath()
 	if err != nil {
 		return nil, err
 	}
-	podNamespace := ""
-	ip, err := s.netPlugin.GetContainerNetworkStatus(netNsPath, podNamespace, *sbName, podInfraContainerName)
+	ip, err := s.netPlugin.GetContainerNetworkStatus(netNsPath, sb.metadata.GetNamespace(), sb.metadata.GetName(), podInfraContainer.ID())
 	if err != nil {
 		// ignore the error on network status
 		ip = ""
 	}
 
+	annotations := make(map[string]string)
+	for k, v := range sb.annotations {
+		annotations[k] = v
+	}
+	if hostPorts := s.sandboxHostPorts(sb.id); hostPorts != nil {
+		data, err := json.Marshal(hostPorts)
+		if err != nil {
+			return nil, err
+		}
+		annotations[portMappingsAnnotation] = string(data)
+	}
+
 	return &pb.PodSandboxStatusResponse{
 		Status: &pb.PodSandboxStatus{
-			Id:        sbName,
-			CreatedAt: int64Ptr(created),
+			Id:        sPtr(sb.id),
+			Metadata:  sb.metadata,
+			CreatedAt: int64Ptr(sb.created.Unix()),
 			Linux: &pb.LinuxPodSandboxStatus{
 				Namespaces: &pb.Namespace{
 					Network: sPtr(netNsPath),
 				},
 			},
-			Network: &pb.PodSandboxNetworkStatus{Ip: &ip},
+			Network:     &pb.PodSandboxNetworkStatus{Ip: &ip},
+			Labels:      sb.labels,
+			Annotations: annotations,
 		},
 	}, nil
 }
 
-// ListPodSandbox returns a list of SandBox.
-func (s *Server) ListPodSandbox(context.Context, *pb.ListPodSandboxRequest) (*pb.ListPodSandboxResponse, error) {
-	return nil, nil
+// filterSandbox returns whether passed sandbox matches filtering criteria
+func filterSandbox(p *pb.PodSandbox, filter *pb.PodSandboxFilter) bool {
+	if filter == nil {
+		return true
+	}
+	if filter.Id != nil && filter.GetId() != p.GetId() {
+		return false
+	}
+	if filter.Name != nil && filter.GetName() != p.GetMetadata().GetName() {
+		return false
+	}
+	if filter.State != nil && filter.GetState() != p.GetState() {
+		return false
+	}
+	return labelsMatch(p.GetLabels(), filter.GetLabelSelector())
+}
+
+// ListPodSandbox returns a list of SandBoxes.
+func (s *Server) ListPodSandbox(ctx context.Context, req *pb.ListPodSandboxRequest) (*pb.ListPodSandboxResponse, error) {
+	pods := []*pb.PodSandbox{}
+	for _, sb := range s.listSandboxes() {
+		podInfraContainer := sb.infraContainer
+		if podInfraContainer == nil {
+			continue
+		}
+
+		rStatus := pb.PodSandBoxState_NOTREADY
+		if err := s.runtime.UpdateStatus(podInfraContainer); err != nil {
+			logrus.Warnf("failed to get status of pod infra container %s: %v", podInfraContainer.ID(), err)
+		} else {
+			cState := s.runtime.ContainerStatus(podInfraContainer)
+			if cState.Status == oci.ContainerStateRunning {
+				rStatus = pb.PodSandBoxState_READY
+			}
+		}
+
+		pod := &pb.PodSandbox{
+			Id:        sPtr(sb.id),
+			Metadata:  sb.metadata,
+			State:     &rStatus,
+			CreatedAt: int64Ptr(sb.created.Unix()),
+			Labels:    sb.labels,
+		}
+
+		if filterSandbox(pod, req.GetFilter()) {
+			pods = append(pods, pod)
+		}
+	}
+
+	return &pb.ListPodSandboxResponse{
+		Items: pods,
+	}, nil
 }
 
 // CreateContainer creates a new container in specified PodSandbox
-func (s *Server) CreateContainer(ctx context.Context, req *pb.CreateContainerRequest) (*pb.CreateContainerResponse, error) {
+func (s *Server) CreateContainer(ctx context.Context, req *pb.CreateContainerRequest) (resp *pb.CreateContainerResponse, err error) {
 	// The id of the PodSandbox
-	podSandboxId := req.GetPodSandboxId()
-	if !s.hasSandbox(podSandboxId) {
-		return nil, fmt.Errorf("the pod sandbox (%s) does not exist", podSandboxId)
+	sb, unlock, err := s.lockSandbox(req.GetPodSandboxId(), false)
+	if err != nil {
+		return nil, err
 	}
+	defer unlock()
 
 	// The config of the container
 	containerConfig := req.GetConfig()
@@ -313,21 +528,23 @@ func (s *Server) CreateContainer(ctx context.Context, req *pb.CreateContainerReq
 		return nil, fmt.Errorf("CreateContainerRequest.ContainerConfig is nil")
 	}
 
-	name := containerConfig.GetMetadata().GetName()
-	if name == "" {
+	if containerConfig.GetMetadata().GetName() == "" {
 		return nil, fmt.Errorf("CreateContainerRequest.ContainerConfig.Name is empty")
 	}
 
-	// containerDir is the dir for the container bundle.
-	containerDir := filepath.Join(s.runtime.ContainerDir(), name)
-
-	if _, err := os.Stat(containerDir); err == nil {
-		return nil, fmt.Errorf("container (%s) already exists", containerDir)
+	id := stringid.GenerateRandomID()
+	name := containerName(containerConfig.GetMetadata(), sb.name)
+	if err := s.reserveName(s.state.containerNames, name, id); err != nil {
+		return nil, fmt.Errorf("failed to reserve container name %s: %v", name, err)
 	}
+	defer func() {
+		if err != nil {
+			s.releaseName(s.state.containerNames, name)
+		}
+	}()
 
-	if err := os.MkdirAll(containerDir, 0755); err != nil {
-		return nil, err
-	}
+	// containerDir is the dir for the container bundle.
+	containerDir := filepath.Join(s.runtime.ContainerDir(), id)
 
 	imageSpec := containerConfig.GetImage()
 	if imageSpec == nil {
@@ -339,6 +556,36 @@ func (s *Server) CreateContainer(ctx context.Context, req *pb.CreateContainerReq
 		return nil, fmt.Errorf("CreateContainerRequest.ContainerConfig.Image.Image is empty")
 	}
 
+	img, err := s.images.Lookup(image)
+	if err != nil {
+		if err == storage.ErrImageUnknown {
+			return nil, fmt.Errorf("image %s has not been pulled", image)
+		}
+		return nil, err
+	}
+
+	imageConfig, err := s.images.Config(img)
+	if err != nil {
+		return nil, err
+	}
+
+	args, err := processArgs(imageConfig, containerConfig.GetCommand(), containerConfig.GetArgs())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(s.runtime.ContainerDir(), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(containerDir, 0755); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(containerDir)
+		}
+	}()
+
 	// creates a spec Generator with the default spec.
 	specgen := generate.New()
 
@@ -346,29 +593,27 @@ func (s *Server) CreateContainer(ctx context.Context, req *pb.CreateContainerReq
 	// here set it to be "rootfs".
 	specgen.SetRootPath("rootfs")
 
-	args := containerConfig.GetArgs()
-	if args == nil {
-		args = []string{"/bin/sh"}
-	}
 	specgen.SetProcessArgs(args)
 
+	specgen.SetLinuxCgroupsPath(containerCgroup(sb.cgroupParent, id))
+
 	cwd := containerConfig.GetWorkingDir()
+	if cwd == "" {
+		cwd = imageConfig.WorkingDir
+	}
 	if cwd == "" {
 		cwd = "/"
 	}
 	specgen.SetProcessCwd(cwd)
 
-	envs := containerConfig.GetEnvs()
-	if envs != nil {
-		for _, item := range envs {
-			key := item.GetKey()
-			value := item.GetValue()
-			if key == "" {
-				continue
-			}
-			env := fmt.Sprintf("%s=%s", key, value)
-			specgen.AddProcessEnv(env)
-		}
+	// the environment of the image replaces the default one of the spec
+	// when it has one.
+	env := processEnv(imageConfig, containerConfig.GetEnvs())
+	if len(imageConfig.Env) > 0 {
+		specgen.ClearProcessEnv()
+	}
+	for _, e := range env {
+		specgen.AddProcessEnv(e)
 	}
 
 	mounts := containerConfig.GetMounts()
@@ -413,12 +658,28 @@ func (s *Server) CreateContainer(ctx context.Context, req *pb.CreateContainerReq
 		specgen.SetRootReadonly(true)
 	}
 
+	// the output of the container is captured to log_path, relative to
+	// the log directory of the sandbox
 	logPath := containerConfig.GetLogPath()
+	if logPath != "" {
+		if filepath.IsAbs(logPath) {
+			return nil, fmt.Errorf("log path %s should be relative to the log directory of the sandbox", logPath)
+		}
+		logPath = filepath.Join(sb.logDir, logPath)
+		rel, err := filepath.Rel(sb.logDir, logPath)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("log path %s is outside of the log directory of the sandbox", containerConfig.GetLogPath())
+		}
+		if err := os.MkdirAll(filepath.Dir(logPath), 0700); err != nil {
+			return nil, err
+		}
+	}
 
 	if containerConfig.GetTty() {
 		specgen.SetProcessTerminal(true)
 	}
 
+	userSet := false
 	linux := containerConfig.GetLinux()
 	if linux != nil {
 		resources := linux.GetResources()
@@ -495,6 +756,7 @@ func (s *Server) CreateContainer(ctx context.Context, req *pb.CreateContainerReq
 
 		user := linux.GetUser()
 		if user != nil {
+			userSet = true
 			uid := user.GetUid()
 			specgen.SetProcessUID(uint32(uid))
 
@@ -515,9 +777,7 @@ func (s *Server) CreateContainer(ctx context.Context, req *pb.CreateContainerReq
 	fmt.Printf("sandboxConfig: %v\n", sandboxConfig)
 
 	// Join the namespace paths for the pod sandbox container.
-	podContainerName := podSandboxId + "-infra"
-	podInfraContainer := s.state.containers[podContainerName]
-	podInfraState := s.runtime.ContainerStatus(podInfraContainer)
+	podInfraState := s.runtime.ContainerStatus(sb.infraContainer)
 
 	logrus.Infof("pod container state %v", podInfraState)
 
@@ -530,46 +790,64 @@ func (s *Server) CreateContainer(ctx context.Context, req *pb.CreateContainerReq
 		specgen.AddOrReplaceLinuxNamespace(nsType, nsPath)
 	}
 
-	if err := specgen.SaveToFile(filepath.Join(containerDir, "config.json")); err != nil {
+	if err := s.images.CreateRootfs(img, containerDir); err != nil {
 		return nil, err
 	}
 
-	// TODO: copy the rootfs into the bundle.
-	// Currently, utils.CreateFakeRootfs is used to populate the rootfs.
-	if err := utils.CreateFakeRootfs(containerDir, image); err != nil {
+	// the user and the volumes of the image can only be resolved once
+	// its rootfs is in place.
+	err = setupImageRootfs(&specgen, containerDir, imageConfig, mounts, !userSet)
+	if err == nil {
+		err = specgen.SaveToFile(filepath.Join(containerDir, "config.json"))
+	}
+	if err != nil {
+		if err1 := s.images.RemoveRootfs(containerDir); err1 != nil {
+			return nil, fmt.Errorf("%v; failed to remove %s rootfs: %v", err, id, err1)
+		}
 		return nil, err
 	}
 
-	container, err := oci.NewContainer(name, containerDir, logPath, labels, podSandboxId)
+	container, err := oci.NewContainer(id, name, containerDir, logPath, labels, annotations, imageSpec, img.ID, containerConfig.GetMetadata(), mounts, sb.id, imageConfig.StopSignal, containerConfig.GetStdin(), containerConfig.GetStdinOnce())
 	if err != nil {
 		return nil, err
 	}
 
 	if err := s.runtime.CreateContainer(container); err != nil {
+		if err1 := s.images.RemoveRootfs(containerDir); err1 != nil {
+			return nil, fmt.Errorf("%v; failed to remove %s rootfs: %v", err, id, err1)
+		}
 		return nil, err
 	}
 
-	s.addContainer(container)
+	if err := s.addContainer(container); err != nil {
+		if err1 := s.runtime.DeleteContainer(container); err1 != nil {
+			logrus.Warnf("failed to delete container %s: %v", id, err1)
+		}
+		if err1 := s.images.RemoveRootfs(containerDir); err1 != nil {
+			logrus.Warnf("failed to remove %s rootfs: %v", id, err1)
+		}
+		return nil, err
+	}
 
 	return &pb.CreateContainerResponse{
-		ContainerId: &name,
+		ContainerId: &id,
 	}, nil
 }
 
 // StartContainer starts the container.
 func (s *Server) StartContainer(ctx context.Context, req *pb.StartContainerRequest) (*pb.StartContainerResponse, error) {
-	containerName := req.ContainerId
-
-	if *containerName == "" {
-		return nil, fmt.Errorf("PodSandboxId should not be empty")
+	containerID := req.GetContainerId()
+	if containerID == "" {
+		return nil, fmt.Errorf("ContainerId should not be empty")
 	}
-	c := s.state.containers[*containerName]
-	if c == nil {
-		return nil, fmt.Errorf("specified container not found: %s", *containerName)
+	c, unlock, err := s.lockContainer(containerID)
+	if err != nil {
+		return nil, err
 	}
+	defer unlock()
 
 	if err := s.runtime.StartContainer(c); err != nil {
-		return nil, fmt.Errorf("failed to start container %s in sandbox %s: %v", c.Name(), *containerName, err)
+		return nil, fmt.Errorf("failed to start container %s in sandbox %s: %v", c.ID(), c.Sandbox(), err)
 	}
 
 	return &pb.StartContainerResponse{}, nil
@@ -577,18 +855,18 @@ func (s *Server) StartContainer(ctx context.Context, req *pb.StartContainerReque
 
 // StopContainer stops a running container with a grace period (i.e., timeout).
 func (s *Server) StopContainer(ctx context.Context, req *pb.StopContainerRequest) (*pb.StopContainerResponse, error) {
-	containerName := req.ContainerId
-
-	if *containerName == "" {
-		return nil, fmt.Errorf("PodSandboxId should not be empty")
+	containerID := req.GetContainerId()
+	if containerID == "" {
+		return nil, fmt.Errorf("ContainerId should not be empty")
 	}
-	c := s.state.containers[*containerName]
-	if c == nil {
-		return nil, fmt.Errorf("specified container not found: %s", *containerName)
+	c, unlock, err := s.lockContainer(containerID)
+	if err != nil {
+		return nil, err
 	}
+	defer unlock()
 
-	if err := s.runtime.StopContainer(c); err != nil {
-		return nil, fmt.Errorf("failed to stop container %s: %v", *containerName, err)
+	if err := s.runtime.StopContainer(c, time.Duration(req.GetTimeout())*time.Second); err != nil {
+		return nil, fmt.Errorf("failed to stop container %s: %v", c.ID(), err)
 	}
 
 	return &pb.StopContainerResponse{}, nil
@@ -597,23 +875,26 @@ func (s *Server) StopContainer(ctx context.Context, req *pb.StopContainerRequest
 // RemoveContainer removes the container. If the container is running, the container
 // should be force removed.
 func (s *Server) RemoveContainer(ctx context.Context, req *pb.RemoveContainerRequest) (*pb.RemoveContainerResponse, error) {
-	containerName := req.ContainerId
-
-	if *containerName == "" {
-		return nil, fmt.Errorf("PodSandboxId should not be empty")
+	containerID := req.GetContainerId()
+	if containerID == "" {
+		return nil, fmt.Errorf("ContainerId should not be empty")
 	}
-	c := s.state.containers[*containerName]
-	if c == nil {
-		return nil, fmt.Errorf("specified container not found: %s", *containerName)
+	c, unlock, err := s.lockContainer(containerID)
+	if err != nil {
+		return nil, err
 	}
+	defer unlock()
 
 	if err := s.runtime.DeleteContainer(c); err != nil {
-		return nil, fmt.Errorf("failed to delete container %s: %v", *containerName, err)
+		return nil, fmt.Errorf("failed to delete container %s: %v", c.ID(), err)
 	}
 
-	containerDir := filepath.Join(s.runtime.ContainerDir(), *containerName)
+	containerDir := filepath.Join(s.runtime.ContainerDir(), c.ID())
+	if err := s.images.RemoveRootfs(containerDir); err != nil {
+		return nil, fmt.Errorf("failed to remove container %s rootfs: %v", c.ID(), err)
+	}
 	if err := os.RemoveAll(containerDir); err != nil {
-		return nil, fmt.Errorf("failed to remove container %s directory: %v", *containerName, err)
+		return nil, fmt.Errorf("failed to remove container %s directory: %v", c.ID(), err)
 	}
 
 	s.removeContainer(c)
@@ -621,17 +902,103 @@ func (s *Server) RemoveContainer(ctx context.Context, req *pb.RemoveContainerReq
 	return &pb.RemoveContainerResponse{}, nil
 }
 
+// filterContainer returns whether passed container matches filtering criteria
+func filterContainer(c *pb.Container, sandbox string, filter *pb.ContainerFilter) bool {
+	if filter == nil {
+		return true
+	}
+	if filter.Id != nil && filter.GetId() != c.GetId() {
+		return false
+	}
+	if filter.Name != nil && filter.GetName() != c.GetMetadata().GetName() {
+		return false
+	}
+	if filter.State != nil && filter.GetState() != c.GetState() {
+		return false
+	}
+	if filter.PodSandboxId != nil && filter.GetPodSandboxId() != sandbox {
+		return false
+	}
+	return labelsMatch(c.GetLabels(), filter.GetLabelSelector())
+}
+
 // ListContainers lists all containers by filters.
-func (s *Server) ListContainers(context.Context, *pb.ListContainersRequest) (*pb.ListContainersResponse, error) {
-	return nil, nil
+func (s *Server) ListContainers(ctx context.Context, req *pb.ListContainersRequest) (*pb.ListContainersResponse, error) {
+	ctrs := []*pb.Container{}
+	for _, ctr := range s.listContainers() {
+		// the pod infra container is an implementation detail of the sandbox
+		if s.isInfraContainer(ctr) {
+			continue
+		}
+
+		rState := pb.ContainerState_UNKNOWN
+		if err := s.runtime.UpdateStatus(ctr); err != nil {
+			logrus.Warnf("failed to get status of container %s: %v", ctr.ID(), err)
+		} else {
+			rState = containerState(s.runtime.ContainerStatus(ctr))
+		}
+
+		c := &pb.Container{
+			Id:          sPtr(ctr.ID()),
+			Metadata:    ctr.Metadata(),
+			Image:       ctr.Image(),
+			ImageRef:    sPtr(ctr.ImageRef()),
+			State:       &rState,
+			Labels:      ctr.Labels(),
+			Annotations: ctr.Annotations(),
+		}
+
+		if filterContainer(c, ctr.Sandbox(), req.GetFilter()) {
+			ctrs = append(ctrs, c)
+		}
+	}
+
+	return &pb.ListContainersResponse{
+		Containers: ctrs,
+	}, nil
 }
 
 // ContainerStatus returns status of the container.
-func (s *Server) ContainerStatus(context.Context, *pb.ContainerStatusRequest) (*pb.ContainerStatusResponse, error) {
-	return nil, nil
-}
+func (s *Server) ContainerStatus(ctx context.Context, req *pb.ContainerStatusRequest) (*pb.ContainerStatusResponse, error) {
+	containerID := req.GetContainerId()
+	if containerID == "" {
+		return nil, fmt.Errorf("ContainerId should not be empty")
+	}
+	c, err := s.lookupContainer(containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.runtime.UpdateStatus(c); err != nil {
+		return nil, err
+	}
 
-// Exec executes the command in the container.
-func (s *Server) Exec(pb.RuntimeService_ExecServer) error {
-	return nil
+	cState := s.runtime.ContainerStatus(c)
+	rState := containerState(cState)
+
+	status := &pb.ContainerStatus{
+		Id:          sPtr(c.ID()),
+		Metadata:    c.Metadata(),
+		State:       &rState,
+		CreatedAt:   int64Ptr(cState.Created.Unix()),
+		Image:       c.Image(),
+		ImageRef:    sPtr(c.ImageRef()),
+		Labels:      c.Labels(),
+		Annotations: c.Annotations(),
+		Mounts:      c.Mounts(),
+	}
+
+	switch rState {
+	case pb.ContainerState_RUNNING:
+		status.StartedAt = int64Ptr(cState.Started.Unix())
+	case pb.ContainerState_EXITED:
+		status.StartedAt = int64Ptr(cState.Started.Unix())
+		status.FinishedAt = int64Ptr(cState.Finished.Unix())
+		status.ExitCode = &cState.ExitCode
+		status.Reason = sPtr(exitReason(cState))
+	}
+
+	return &pb.ContainerStatusResponse{
+		Status: status,
+	}, nil
 }
@@ -2,10 +2,14 @@ package server
 
 import (
 	"fmt"
-	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/kubernetes-incubator/ocid/oci"
+	"github.com/kubernetes-incubator/ocid/storage"
 	"github.com/kubernetes-incubator/ocid/utils"
+	pb "github.com/kubernetes/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
 	"github.com/rajatchopra/ocicni"
 )
 
@@ -17,13 +21,36 @@ const (
 // Server implements the RuntimeService and ImageService
 type Server struct {
 	runtime    *oci.Runtime
+	images     *storage.Store
 	sandboxDir string
 	state      *serverState
 	netPlugin  ocicni.CNIPlugin
+
+	// pauseImage is the image the infra containers of the sandboxes run
+	// pauseCommand from.
+	pauseImage   string
+	pauseCommand string
+	// insecureRegistries are the registries which may be pulled from, and
+	// the credentials of pulls sent to, over plain http.
+	insecureRegistries []string
+	// pauseLock serializes the pull of the pause image.
+	pauseLock sync.Mutex
+	// pause caches the pause image and its rootfs once resolved, until
+	// an image is pulled or removed.
+	pause struct {
+		sync.RWMutex
+		img    *storage.Image
+		rootfs string
+	}
+
+	// execSessions are the running exec sessions with a terminal, by ID,
+	// so that their terminal can be resized.
+	execLock     sync.Mutex
+	execSessions map[string]*execSession
 }
 
 // New creates a new Server with options provided
-func New(runtimePath, sandboxDir, containerDir string) (*Server, error) {
+func New(runtimePath, conmonPath, sandboxDir, containerDir, pauseImage, pauseCommand string, logSizeMax int64, logMaxFiles int, insecureRegistries []string) (*Server, error) {
 	// TODO: This will go away later when we have wrapper process or systemd acting as
 	// subreaper.
 	if err := utils.SetSubreaper(1); err != nil {
@@ -32,11 +59,12 @@ func New(runtimePath, sandboxDir, containerDir string) (*Server, error) {
 
 	utils.StartReaper()
 
-	if err := os.MkdirAll(imageStore, 0755); err != nil {
+	images, err := storage.New(imageStore)
+	if err != nil {
 		return nil, err
 	}
 
-	r, err := oci.New(runtimePath, containerDir)
+	r, err := oci.New(runtimePath, conmonPath, containerDir, logSizeMax, logMaxFiles)
 	if err != nil {
 		return nil, err
 	}
@@ -46,54 +74,287 @@ func New(runtimePath, sandboxDir, containerDir string) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Server{
-		runtime:    r,
-		netPlugin:  netPlugin,
-		sandboxDir: sandboxDir,
+	s := &Server{
+		runtime:            r,
+		images:             images,
+		netPlugin:          netPlugin,
+		sandboxDir:         sandboxDir,
+		pauseImage:         pauseImage,
+		pauseCommand:       pauseCommand,
+		insecureRegistries: insecureRegistries,
+		execSessions:       make(map[string]*execSession),
 		state: &serverState{
-			sandboxes:  sandboxes,
-			containers: containers,
+			sandboxes:      sandboxes,
+			containers:     containers,
+			sandboxNames:   make(map[string]string),
+			containerNames: make(map[string]string),
+			hostPorts:      make(map[string][]*hostPort),
 		},
-	}, nil
+	}
+	if err := s.restore(); err != nil {
+		return nil, fmt.Errorf("failed to restore state: %v", err)
+	}
+	return s, nil
 }
 
 type serverState struct {
+	// lock protects the maps of the state, including the containers map
+	// of each sandbox.
+	lock       sync.RWMutex
 	sandboxes  map[string]*sandbox
 	containers map[string]*oci.Container
+	// sandboxNames and containerNames map the reserved names to the IDs
+	// of the sandboxes and containers holding them.
+	sandboxNames   map[string]string
+	containerNames map[string]string
+	// hostPorts are the host ports forwarded to the sandboxes, by ID.
+	hostPorts map[string][]*hostPort
 }
 
 type sandbox struct {
-	name       string
-	logDir     string
-	labels     map[string]string
-	containers map[string]*oci.Container
+	// opLock is held for writing by the operations on the whole sandbox
+	// and for reading by the operations on its containers, so that the
+	// sandbox is not stopped or removed under them.
+	opLock      sync.RWMutex
+	id          string
+	name        string
+	metadata    *pb.PodSandboxMetadata
+	logDir      string
+	labels      map[string]string
+	annotations map[string]string
+	created     time.Time
+	// cgroupParent is the slice the containers of the sandbox are placed
+	// beneath, bounded by the resources of the pod.
+	cgroupParent   string
+	containers     map[string]*oci.Container
+	infraContainer *oci.Container
 }
 
+// sandboxName returns the name reserved by a sandbox, unique for a given
+// attempt of a pod.
+func sandboxName(metadata *pb.PodSandboxMetadata) string {
+	return fmt.Sprintf("%s_%s_%s_%d", metadata.GetName(), metadata.GetNamespace(), metadata.GetUid(), metadata.GetAttempt())
+}
+
+// containerName returns the name reserved by a container of the sandbox
+// named sandboxName, unique for a given attempt of the container.
+func containerName(metadata *pb.ContainerMetadata, sandboxName string) string {
+	return fmt.Sprintf("%s_%s_%d", metadata.GetName(), sandboxName, metadata.GetAttempt())
+}
+
+// reserveName reserves name for id in names. It fails if name is already
+// held by another sandbox or container.
+func (s *Server) reserveName(names map[string]string, name, id string) error {
+	s.state.lock.Lock()
+	defer s.state.lock.Unlock()
+	if holder, ok := names[name]; ok && holder != id {
+		return fmt.Errorf("name %s is reserved by %s", name, holder)
+	}
+	names[name] = id
+	return nil
+}
+
+func (s *Server) releaseName(names map[string]string, name string) {
+	s.state.lock.Lock()
+	delete(names, name)
+	s.state.lock.Unlock()
+}
+
+// lookupID returns the ID in ids which is either id or the only one
+// starting with id.
+func lookupID(ids []string, id string) (string, error) {
+	if id == "" {
+		return "", fmt.Errorf("ID should not be empty")
+	}
+	var found []string
+	for _, i := range ids {
+		if i == id {
+			return i, nil
+		}
+		if strings.HasPrefix(i, id) {
+			found = append(found, i)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no such ID: %s", id)
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("ID prefix %s is ambiguous", id)
+	}
+}
+
+// addSandbox adds sb along with its infra container, so that the sandbox
+// is never seen without it.
 func (s *Server) addSandbox(sb *sandbox) {
-	s.state.sandboxes[sb.name] = sb
+	s.state.lock.Lock()
+	defer s.state.lock.Unlock()
+	s.state.sandboxes[sb.id] = sb
+	if c := sb.infraContainer; c != nil {
+		sb.containers[c.ID()] = c
+		s.state.containers[c.ID()] = c
+	}
 }
 
-func (s *Server) hasSandbox(name string) bool {
-	_, ok := s.state.sandboxes[name]
-	return ok
+func (s *Server) removeSandbox(sb *sandbox) {
+	s.state.lock.Lock()
+	delete(s.state.sandboxes, sb.id)
+	delete(s.state.sandboxNames, sb.name)
+	delete(s.state.hostPorts, sb.id)
+	s.state.lock.Unlock()
 }
 
-func (s *sandbox) addContainer(c *oci.Container) {
-	s.containers[c.Name()] = c
+func (s *Server) getSandbox(id string) *sandbox {
+	s.state.lock.RLock()
+	defer s.state.lock.RUnlock()
+	return s.state.sandboxes[id]
 }
 
-func (s *sandbox) removeContainer(c *oci.Container) {
-	delete(s.containers, c.Name())
+// lookupSandbox returns the sandbox whose ID is id or starts with id.
+func (s *Server) lookupSandbox(id string) (*sandbox, error) {
+	s.state.lock.RLock()
+	defer s.state.lock.RUnlock()
+	ids := make([]string, 0, len(s.state.sandboxes))
+	for i := range s.state.sandboxes {
+		ids = append(ids, i)
+	}
+	full, err := lookupID(ids, id)
+	if err != nil {
+		return nil, fmt.Errorf("specified sandbox not found: %v", err)
+	}
+	return s.state.sandboxes[full], nil
 }
 
-func (s *Server) addContainer(c *oci.Container) {
+// listSandboxes returns a snapshot of the sandboxes.
+func (s *Server) listSandboxes() []*sandbox {
+	s.state.lock.RLock()
+	defer s.state.lock.RUnlock()
+	sandboxes := make([]*sandbox, 0, len(s.state.sandboxes))
+	for _, sb := range s.state.sandboxes {
+		sandboxes = append(sandboxes, sb)
+	}
+	return sandboxes
+}
+
+// lockSandbox looks up the sandbox whose ID is id or starts with id and
+// takes its operation lock, for writing if exclusive is set. The returned
+// function releases the lock.
+func (s *Server) lockSandbox(id string, exclusive bool) (*sandbox, func(), error) {
+	sb, err := s.lookupSandbox(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	unlock := sb.opLock.RUnlock
+	if exclusive {
+		sb.opLock.Lock()
+		unlock = sb.opLock.Unlock
+	} else {
+		sb.opLock.RLock()
+	}
+	// the sandbox may have been removed while we were waiting
+	if s.getSandbox(sb.id) != sb {
+		unlock()
+		return nil, nil, fmt.Errorf("specified sandbox not found: %s", id)
+	}
+	return sb, unlock, nil
+}
+
+// sandboxContainers returns a snapshot of the containers of sb.
+func (s *Server) sandboxContainers(sb *sandbox) []*oci.Container {
+	s.state.lock.RLock()
+	defer s.state.lock.RUnlock()
+	containers := make([]*oci.Container, 0, len(sb.containers))
+	for _, c := range sb.containers {
+		containers = append(containers, c)
+	}
+	return containers
+}
+
+// isInfraContainer returns whether c is the infra container of its
+// sandbox, which is an implementation detail of the sandbox.
+func (s *Server) isInfraContainer(c *oci.Container) bool {
+	sb := s.getSandbox(c.Sandbox())
+	return sb != nil && sb.infraContainer == c
+}
+
+// addContainer adds c to its sandbox. It fails if the sandbox is gone.
+func (s *Server) addContainer(c *oci.Container) error {
+	s.state.lock.Lock()
+	defer s.state.lock.Unlock()
 	sandbox := s.state.sandboxes[c.Sandbox()]
-	sandbox.addContainer(c)
-	s.state.containers[c.Name()] = c
+	if sandbox == nil {
+		return fmt.Errorf("sandbox %s of container %s not found", c.Sandbox(), c.ID())
+	}
+	sandbox.containers[c.ID()] = c
+	s.state.containers[c.ID()] = c
+	return nil
 }
 
 func (s *Server) removeContainer(c *oci.Container) {
-	sandbox := s.state.sandboxes[c.Sandbox()]
-	sandbox.removeContainer(c)
-	delete(s.state.containers, c.Name())
+	s.state.lock.Lock()
+	defer s.state.lock.Unlock()
+	if sandbox := s.state.sandboxes[c.Sandbox()]; sandbox != nil {
+		delete(sandbox.containers, c.ID())
+	}
+	delete(s.state.containers, c.ID())
+	delete(s.state.containerNames, c.Name())
+}
+
+func (s *Server) getContainer(id string) *oci.Container {
+	s.state.lock.RLock()
+	defer s.state.lock.RUnlock()
+	return s.state.containers[id]
+}
+
+// lookupContainer returns the container whose ID is id or starts with id.
+func (s *Server) lookupContainer(id string) (*oci.Container, error) {
+	s.state.lock.RLock()
+	defer s.state.lock.RUnlock()
+	ids := make([]string, 0, len(s.state.containers))
+	for i := range s.state.containers {
+		ids = append(ids, i)
+	}
+	full, err := lookupID(ids, id)
+	if err != nil {
+		return nil, fmt.Errorf("specified container not found: %v", err)
+	}
+	return s.state.containers[full], nil
+}
+
+// listContainers returns a snapshot of the containers.
+func (s *Server) listContainers() []*oci.Container {
+	s.state.lock.RLock()
+	defer s.state.lock.RUnlock()
+	containers := make([]*oci.Container, 0, len(s.state.containers))
+	for _, c := range s.state.containers {
+		containers = append(containers, c)
+	}
+	return containers
+}
+
+// lockContainer looks up the container whose ID is id or starts with id and
+// serializes the operation about to be done on it with the other operations
+// on the container and on its sandbox. The returned function releases the
+// locks.
+func (s *Server) lockContainer(id string) (*oci.Container, func(), error) {
+	c, err := s.lookupContainer(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, unlockSandbox, err := s.lockSandbox(c.Sandbox(), false)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.Lock()
+	// the container may have been removed while we were waiting
+	if s.getContainer(c.ID()) != c {
+		c.Unlock()
+		unlockSandbox()
+		return nil, nil, fmt.Errorf("specified container not found: %s", id)
+	}
+	return c, func() {
+		c.Unlock()
+		unlockSandbox()
+	}, nil
 }
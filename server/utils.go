@@ -9,7 +9,9 @@ import (
 	"runtime"
 	"strings"
 
+	"github.com/kubernetes-incubator/ocid/oci"
 	"github.com/kubernetes-incubator/ocid/utils"
+	pb "github.com/kubernetes/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
 	"github.com/opencontainers/ocitools/generate"
 )
 
@@ -97,17 +99,25 @@ func parseDNSOptions(servers, searches []string, path string) error {
 
 // kubernetes compute resources - CPU: http://kubernetes.io/docs/user-guide/compute-resources/#meaning-of-cpu
 func setResourcesCPU(limits, requests, defaultCores float64, g generate.Generator) error {
-	if requests > limits {
+	if limits != 0 && requests > limits {
 		return fmt.Errorf("CPU.Requests should not be greater than CPU.Limits")
 	}
 
-	cores := defaultCores
-	if limits != 0 || requests != 0 {
-		if limits > requests {
-			cores = limits
-		} else {
-			cores = requests
+	// requests are a relative weight, of 1024 shares per core
+	if requests != 0 {
+		shares := uint64(requests * 1024)
+		if shares < minCPUShares {
+			shares = minCPUShares
 		}
+		g.SetLinuxResourcesCPUShares(shares)
+	}
+
+	cores := limits
+	if cores == 0 {
+		cores = defaultCores
+	}
+	if cores == 0 {
+		return nil
 	}
 
 	period := uint64(defaultCPUCFSPeriod)
@@ -131,7 +141,7 @@ func setResourcesCPU(limits, requests, defaultCores float64, g generate.Generato
 
 // kubernetes compute resources - Memory: http://kubernetes.io/docs/user-guide/compute-resources/#meaning-of-memory
 func setResourcesMemory(limits, requests, defaultMem float64, g generate.Generator) error {
-	if requests > limits {
+	if limits != 0 && requests > limits {
 		return fmt.Errorf("Memory.Requests should not be greater than Memory.Limits")
 	}
 
@@ -141,6 +151,9 @@ func setResourcesMemory(limits, requests, defaultMem float64, g generate.Generat
 		}
 	} else {
 		if requests == 0 {
+			if defaultMem == 0 {
+				return nil
+			}
 			// set the default values of limits and requests
 			requests = defaultMem
 			limits = defaultMem
@@ -153,3 +166,42 @@ func setResourcesMemory(limits, requests, defaultMem float64, g generate.Generat
 	g.SetLinuxResourcesMemoryReservation(uint64(requests))
 	return nil
 }
+
+// labelsMatch returns whether all the key/value pairs in selector are
+// present in labels.
+func labelsMatch(labels, selector map[string]string) bool {
+	for k, v := range selector {
+		if val, ok := labels[k]; !ok || val != v {
+			return false
+		}
+	}
+	return true
+}
+
+// containerState maps the status reported by the OCI runtime to a CRI
+// container state.
+func containerState(cState *oci.ContainerState) pb.ContainerState {
+	switch cState.Status {
+	case oci.ContainerStateCreated:
+		return pb.ContainerState_CREATED
+	case oci.ContainerStateRunning:
+		return pb.ContainerState_RUNNING
+	case oci.ContainerStateStopped:
+		return pb.ContainerState_EXITED
+	default:
+		return pb.ContainerState_UNKNOWN
+	}
+}
+
+// exitReason returns a brief CamelCase string explaining why a container
+// exited.
+func exitReason(cState *oci.ContainerState) string {
+	switch {
+	case cState.OOMKilled:
+		return "OOMKilled"
+	case cState.ExitCode == 0:
+		return "Completed"
+	default:
+		return "Error"
+	}
+}
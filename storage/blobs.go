@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/digest"
+)
+
+// blobsDir is the directory below the root of the store holding the blobs
+// of all the images, keyed by digest.
+const blobsDir = ".blobs"
+
+// validateDigest returns an error unless blob is a digest of a supported
+// algorithm, which is safe to use as a path.
+func validateDigest(blob string) error {
+	d, err := digest.ParseDigest(blob)
+	if err != nil {
+		return fmt.Errorf("invalid digest %q: %v", blob, err)
+	}
+	if len(d.Hex()) != d.Algorithm().Size()*2 {
+		return fmt.Errorf("invalid digest %q: wrong length", blob)
+	}
+	return nil
+}
+
+// blobPath returns the path of the blob with the given digest, which is
+// <alg>/<hex> below the blob store.
+func (s *Store) blobPath(blob string) (string, error) {
+	if err := validateDigest(blob); err != nil {
+		return "", err
+	}
+	d := digest.Digest(blob)
+	return filepath.Join(s.root, blobsDir, string(d.Algorithm()), d.Hex()), nil
+}
+
+// hasBlob returns whether the blob with the given digest is stored.
+func (s *Store) hasBlob(blob string) bool {
+	p, err := s.blobPath(blob)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(p)
+	return err == nil
+}
+
+// commitBlob moves the verified blob at path in the blob store.
+func (s *Store) commitBlob(path, blob string) error {
+	dest, err := s.blobPath(blob)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	return os.Rename(path, dest)
+}
+
+// legacyBlobPath returns the path of a blob of an image pulled before blobs
+// were shared, following the conventions of the containers/image dir
+// transport.
+func legacyBlobPath(dir, blob string) string {
+	return filepath.Join(dir, strings.TrimPrefix(blob, "sha256:")+".tar")
+}
+
+// migrateBlobs moves the blobs kept in the image directories to the blob
+// store.
+func (s *Store) migrateBlobs() error {
+	refs, err := s.refs()
+	if err != nil {
+		return err
+	}
+	for _, r := range refs {
+		for _, b := range r.manifest.Blobs() {
+			p := legacyBlobPath(r.dir, b)
+			if _, err := os.Stat(p); err != nil {
+				continue
+			}
+			if s.hasBlob(b) {
+				err = os.Remove(p)
+			} else {
+				err = s.commitBlob(p, b)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to migrate blob %s of %s: %v", b, r.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// collectGarbage removes the blobs and the cached layers no stored image
+// references, which are left behind when ocid stops in the middle of a
+// pull or once the images using them are removed.
+func (s *Store) collectGarbage() error {
+	refs, err := s.refs()
+	if err != nil {
+		return err
+	}
+	inUse := make(map[string]bool)
+	for _, r := range refs {
+		for _, b := range r.manifest.Blobs() {
+			p, err := s.blobPath(b)
+			if err != nil {
+				return err
+			}
+			inUse[p] = true
+		}
+	}
+	err = filepath.Walk(filepath.Join(s.root, blobsDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || inUse[path] {
+			return nil
+		}
+		logrus.Debugf("removing unreferenced blob %s", path)
+		return os.Remove(path)
+	})
+	if err != nil {
+		return err
+	}
+	return s.collectLayers(refs)
+}
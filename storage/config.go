@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/containers/image/manifest"
+)
+
+// ImageConfig is the part of the configuration of an image used to run
+// containers from it.
+type ImageConfig struct {
+	User       string              `json:"User"`
+	Env        []string            `json:"Env"`
+	Entrypoint []string            `json:"Entrypoint"`
+	Cmd        []string            `json:"Cmd"`
+	WorkingDir string              `json:"WorkingDir"`
+	Volumes    map[string]struct{} `json:"Volumes"`
+	StopSignal string              `json:"StopSignal"`
+}
+
+type imageConfigBlob struct {
+	Config *ImageConfig `json:"config"`
+}
+
+type manifestSchema1History struct {
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+}
+
+// Config returns the configuration of img. Schema 2 and OCI images keep it
+// in the config blob, schema 1 images in the top-most history entry of the
+// manifest.
+func (s *Store) Config(img *Image) (*ImageConfig, error) {
+	var raw []byte
+	switch img.Manifest.MIMEType {
+	case manifest.DockerV2Schema1MIMEType, manifest.DockerV2Schema1SignedMIMEType:
+		h := manifestSchema1History{}
+		if err := json.Unmarshal(img.Manifest.Raw, &h); err != nil {
+			return nil, err
+		}
+		if len(h.History) == 0 {
+			return nil, fmt.Errorf("image %s has no history", img.ID)
+		}
+		raw = []byte(h.History[0].V1Compatibility)
+	default:
+		if img.Manifest.Config == "" {
+			return nil, fmt.Errorf("image %s has no config", img.ID)
+		}
+		p, err := s.blobPath(img.Manifest.Config)
+		if err != nil {
+			return nil, err
+		}
+		s.lock.RLock()
+		b, err := ioutil.ReadFile(p)
+		s.lock.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		raw = b
+	}
+
+	c := imageConfigBlob{}
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, fmt.Errorf("failed to parse config of image %s: %v", img.ID, err)
+	}
+	if c.Config == nil {
+		return &ImageConfig{}, nil
+	}
+	return c.Config, nil
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/containers/image/manifest"
+)
+
+// Manifest is the subset of an image manifest ocid cares about.
+type Manifest struct {
+	// Raw is the manifest as stored on disk.
+	Raw []byte
+	// MIMEType is the media type of the manifest.
+	MIMEType string
+	// Digest is the digest of the manifest.
+	Digest string
+	// Config is the digest of the config blob, empty for schema 1 manifests
+	// which embed the config.
+	Config string
+	// Layers are the digests of the layer blobs, base layer first.
+	Layers []string
+}
+
+type manifestDescriptor struct {
+	Digest string `json:"digest"`
+}
+
+type manifestSchema2 struct {
+	Config manifestDescriptor   `json:"config"`
+	Layers []manifestDescriptor `json:"layers"`
+}
+
+type manifestSchema1 struct {
+	FSLayers []struct {
+		BlobSum string `json:"blobSum"`
+	} `json:"fsLayers"`
+}
+
+// parseManifest parses a docker schema 1, docker schema 2 or OCI manifest.
+func parseManifest(raw []byte) (*Manifest, error) {
+	digest, err := manifest.Digest(raw)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{
+		Raw:      raw,
+		MIMEType: manifest.GuessMIMEType(raw),
+		Digest:   digest,
+	}
+
+	switch m.MIMEType {
+	case manifest.DockerV2Schema1MIMEType, manifest.DockerV2Schema1SignedMIMEType:
+		s1 := manifestSchema1{}
+		if err := json.Unmarshal(raw, &s1); err != nil {
+			return nil, err
+		}
+		// schema 1 lists the layers top-most first
+		for i := len(s1.FSLayers) - 1; i >= 0; i-- {
+			m.Layers = append(m.Layers, s1.FSLayers[i].BlobSum)
+		}
+	case manifest.DockerV2Schema2MIMEType, manifest.OCIV1ImageManifestMIMEType:
+		s2 := manifestSchema2{}
+		if err := json.Unmarshal(raw, &s2); err != nil {
+			return nil, err
+		}
+		m.Config = s2.Config.Digest
+		for _, l := range s2.Layers {
+			m.Layers = append(m.Layers, l.Digest)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported manifest media type %q", m.MIMEType)
+	}
+	// the digests name the files of the blobs
+	blobs := m.Layers
+	if m.Config != "" {
+		blobs = append([]string{m.Config}, blobs...)
+	}
+	for _, b := range blobs {
+		if err := validateDigest(b); err != nil {
+			return nil, fmt.Errorf("invalid manifest: %v", err)
+		}
+	}
+	return m, nil
+}
+
+// Blobs returns the digests of all the blobs referenced by the manifest,
+// without duplicates.
+func (m *Manifest) Blobs() []string {
+	var blobs []string
+	seen := make(map[string]bool)
+	all := make([]string, 0, len(m.Layers)+1)
+	all = append(all, m.Layers...)
+	all = append(all, m.Config)
+	for _, b := range all {
+		if b == "" || seen[b] {
+			continue
+		}
+		seen[b] = true
+		blobs = append(blobs, b)
+	}
+	return blobs
+}
@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/containers/image/image"
+	"github.com/containers/image/manifest"
+	"github.com/containers/image/types"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/docker/reference"
+)
+
+// stagingDir is the directory below the root of the store in which pulls
+// are assembled before being committed.
+const stagingDir = ".staging"
+
+// oldImageFile is the file of a directory of replaced image, in the
+// staging directory, holding the name the image was stored as.
+const oldImageFile = "name"
+
+// cleanupStaging removes the leftovers of pulls interrupted by a crash. An
+// image replaced by a pull which crashed before the new one was in place is
+// moved back first.
+func (s *Store) cleanupStaging() error {
+	staging := filepath.Join(s.root, stagingDir)
+	olds, err := filepath.Glob(filepath.Join(staging, "old-*"))
+	if err != nil {
+		return err
+	}
+	for _, old := range olds {
+		if err := s.restoreReplaced(old); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	return os.MkdirAll(staging, 0755)
+}
+
+// restoreReplaced moves the image replaced by commit in old back to where
+// it was stored, unless the new image made it there.
+func (s *Store) restoreReplaced(old string) error {
+	name, err := ioutil.ReadFile(filepath.Join(old, oldImageFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	dir, err := s.imageDir(string(name))
+	if err != nil {
+		logrus.Warnf("dropping replaced image: %v", err)
+		return nil
+	}
+	image := filepath.Join(old, "image")
+	if _, err := os.Stat(image); err != nil {
+		return nil
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	logrus.Infof("restoring image %s replaced by an interrupted pull", name)
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	return os.Rename(image, dir)
+}
+
+// imageDir returns the directory an image pulled as name is stored in.
+func (s *Store) imageDir(name string) (string, error) {
+	dir := filepath.Join(s.root, name)
+	if name == "" || !strings.HasPrefix(dir, s.root+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid image name %q", name)
+	}
+	return dir, nil
+}
+
+// Pull copies the image provided by src into the store as name. Blobs
+// missing from the store are fetched to a staging directory and verified
+// against their digest before being moved to the blob store. The manifest
+// is committed last so that a failed pull leaves no image behind. Pulling an
+// image which is already stored is a no-op.
+func (s *Store) Pull(name string, src types.ImageSource) error {
+	// references of the docker transport start with //
+	name = strings.TrimPrefix(name, "//")
+	dir, err := s.imageDir(name)
+	if err != nil {
+		return err
+	}
+
+	raw, _, err := image.FromSource(src, nil).Manifest()
+	if err != nil {
+		return err
+	}
+	m, err := parseManifest(raw)
+	if err != nil {
+		return err
+	}
+	if ref, ok := src.Reference().DockerReference().(reference.Canonical); ok {
+		if match, err := manifest.MatchesDigest(raw, ref.Digest().String()); err != nil || !match {
+			return fmt.Errorf("manifest of %s does not match its digest", name)
+		}
+	}
+
+	if current, err := ioutil.ReadFile(filepath.Join(dir, manifestFile)); err == nil {
+		if cm, err := parseManifest(current); err == nil && cm.Digest == m.Digest {
+			logrus.Debugf("image %s is up to date", name)
+			return nil
+		}
+	}
+
+	replaced, err := s.fetch(name, dir, raw, m, src)
+	if err != nil || !replaced {
+		return err
+	}
+	// the blobs and the layers only the replaced image used can go
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.collectGarbage(); err != nil {
+		logrus.Warnf("failed to collect the image replaced by %s: %v", name, err)
+	}
+	return nil
+}
+
+// fetch stages the blobs of the image named name, whose manifest m was
+// parsed from raw, and commits it to dir. It returns whether an image was
+// replaced.
+func (s *Store) fetch(name, dir string, raw []byte, m *Manifest, src types.ImageSource) (bool, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	staging, err := ioutil.TempDir(filepath.Join(s.root, stagingDir), "pull-")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(staging)
+
+	for _, b := range m.Blobs() {
+		if s.hasBlob(b) {
+			logrus.Debugf("blob %s of %s already present", b, name)
+			continue
+		}
+		p := filepath.Join(staging, "blob")
+		if err := fetchBlob(src, b, p); err != nil {
+			return false, fmt.Errorf("failed to fetch blob %s of %s: %v", b, name, err)
+		}
+		if err := s.commitBlob(p, b); err != nil {
+			return false, err
+		}
+	}
+	if err := writeFileSync(filepath.Join(staging, manifestFile), raw); err != nil {
+		return false, err
+	}
+	if err := os.Chmod(staging, 0755); err != nil {
+		return false, err
+	}
+	return s.commit(staging, dir)
+}
+
+// commit moves the fully staged image in staging to dir, replacing the
+// image previously stored there. The replaced image is moved aside along
+// with its name, so that cleanupStaging puts it back if ocid stops before
+// the new one is in place. It returns whether an image was replaced.
+func (s *Store) commit(staging, dir string) (bool, error) {
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(dir); err == nil {
+		old, err := ioutil.TempDir(filepath.Join(s.root, stagingDir), "old-")
+		if err != nil {
+			return false, err
+		}
+		defer os.RemoveAll(old)
+		name, err := filepath.Rel(s.root, dir)
+		if err != nil {
+			return false, err
+		}
+		if err := writeFileSync(filepath.Join(old, oldImageFile), []byte(name)); err != nil {
+			return false, err
+		}
+		if err := os.Rename(dir, filepath.Join(old, "image")); err != nil {
+			return false, err
+		}
+		if err := os.Rename(staging, dir); err != nil {
+			// put the replaced image back
+			if err1 := os.Rename(filepath.Join(old, "image"), dir); err1 != nil {
+				logrus.Warnf("failed to restore image %s: %v", name, err1)
+			}
+			return false, err
+		}
+		return true, nil
+	}
+	return false, os.Rename(staging, dir)
+}
+
+// fetchBlob writes the blob with the given digest to path, failing if the
+// content does not match the digest.
+func fetchBlob(src types.ImageSource, blob, path string) error {
+	d, err := digest.ParseDigest(blob)
+	if err != nil {
+		return err
+	}
+	verifier, err := digest.NewDigestVerifier(d)
+	if err != nil {
+		return err
+	}
+
+	r, _, err := src.GetBlob(blob)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(io.MultiWriter(f, verifier), r); err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("content does not match digest")
+	}
+	return f.Sync()
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,407 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/types"
+	"github.com/docker/docker/reference"
+)
+
+const (
+	dockerHostname = "docker.io"
+	dockerRegistry = "registry-1.docker.io"
+)
+
+// AuthConfig holds the credentials used to pull from a registry. They are
+// only ever kept in memory.
+type AuthConfig struct {
+	Username string
+	Password string
+	// IdentityToken is an OAuth2 refresh token exchanged for bearer tokens.
+	IdentityToken string
+	// RegistryToken is a bearer token sent to the registry as is.
+	RegistryToken string
+}
+
+// registrySource is a types.ImageSource pulling from a docker registry with
+// the credentials it was given rather than the ones of the docker CLI.
+type registrySource struct {
+	ref      types.ImageReference
+	named    reference.Named
+	registry string
+	auth     AuthConfig
+	// insecure allows pulling, and sending the credentials, over plain
+	// http.
+	insecure bool
+	client   *http.Client
+
+	mu     sync.Mutex
+	scheme string
+	tokens map[string]string
+}
+
+// NewRegistrySource returns an image source pulling ref from its registry
+// using the credentials in auth. Plain http is only used, and the
+// credentials only sent over it, if insecure is set.
+func NewRegistrySource(ref types.ImageReference, auth AuthConfig, insecure bool) (types.ImageSource, error) {
+	named := ref.DockerReference()
+	if named == nil {
+		return nil, fmt.Errorf("%s is not a docker reference", ref.StringWithinTransport())
+	}
+	registry := named.Hostname()
+	if registry == dockerHostname {
+		registry = dockerRegistry
+	}
+	return &registrySource{
+		ref:      ref,
+		named:    named,
+		registry: registry,
+		auth:     auth,
+		insecure: insecure,
+		client:   &http.Client{Timeout: 10 * time.Minute},
+		tokens:   make(map[string]string),
+	}, nil
+}
+
+// Reference returns the reference used to set up this source.
+func (s *registrySource) Reference() types.ImageReference {
+	return s.ref
+}
+
+func (s *registrySource) tagOrDigest() string {
+	if ref, ok := s.named.(reference.Canonical); ok {
+		return ref.Digest().String()
+	}
+	if ref, ok := s.named.(reference.NamedTagged); ok {
+		return ref.Tag()
+	}
+	return "latest"
+}
+
+// GetManifest returns the manifest of the image along with its MIME type.
+func (s *registrySource) GetManifest(mimeTypes []string) ([]byte, string, error) {
+	path := fmt.Sprintf("%s/manifests/%s", s.named.RemoteName(), s.tagOrDigest())
+	res, err := s.get(path, map[string][]string{"Accept": mimeTypes})
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	m, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	mimeType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		mimeType = ""
+	}
+	return m, mimeType, nil
+}
+
+// GetBlob returns a stream for the blob with the given digest and its size,
+// or 0 if unknown.
+func (s *registrySource) GetBlob(digest string) (io.ReadCloser, int64, error) {
+	res, err := s.get(fmt.Sprintf("%s/blobs/%s", s.named.RemoteName(), digest), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		size = 0
+	}
+	return res.Body, size, nil
+}
+
+// GetSignatures returns the signatures of the image, registries have none.
+func (s *registrySource) GetSignatures() ([][]byte, error) {
+	return [][]byte{}, nil
+}
+
+// Delete is not supported by the source.
+func (s *registrySource) Delete() error {
+	return fmt.Errorf("deleting images from a registry is not supported")
+}
+
+// get fetches path, relative to the /v2/ endpoint of the registry,
+// authenticating as challenged by the registry.
+func (s *registrySource) get(path string, headers map[string][]string) (*http.Response, error) {
+	scheme, err := s.detectScheme()
+	if err != nil {
+		return nil, err
+	}
+	u := fmt.Sprintf("%s://%s/v2/%s", scheme, s.registry, path)
+
+	var authorization string
+	if s.auth.RegistryToken != "" {
+		if err := s.checkSecure(scheme, s.registry); err != nil {
+			return nil, err
+		}
+		authorization = "Bearer " + s.auth.RegistryToken
+	}
+	res, err := s.do(u, headers, authorization)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusUnauthorized && authorization == "" {
+		challenge := res.Header.Get("WWW-Authenticate")
+		res.Body.Close()
+		authorization, err = s.authorize(scheme, challenge)
+		if err != nil {
+			return nil, err
+		}
+		if res, err = s.do(u, headers, authorization); err != nil {
+			return nil, err
+		}
+		// the cached token may have expired, a new one is fetched once
+		if res.StatusCode == http.StatusUnauthorized && s.forgetToken(challenge) {
+			res.Body.Close()
+			authorization, err = s.authorize(scheme, challenge)
+			if err != nil {
+				return nil, err
+			}
+			if res, err = s.do(u, headers, authorization); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("fetching %s from %s: unexpected status %s", path, s.registry, res.Status)
+	}
+	return res, nil
+}
+
+func (s *registrySource) do(u string, headers map[string][]string, authorization string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Docker-Distribution-API-Version", "registry/2.0")
+	for n, h := range headers {
+		for _, hh := range h {
+			req.Header.Add(n, hh)
+		}
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	return s.client.Do(req)
+}
+
+// detectScheme finds out whether the registry speaks https or, if it is
+// insecure, plain http.
+func (s *registrySource) detectScheme() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.scheme != "" {
+		return s.scheme, nil
+	}
+	schemes := []string{"https"}
+	if s.insecure {
+		schemes = append(schemes, "http")
+	}
+	var err error
+	for _, scheme := range schemes {
+		var res *http.Response
+		res, err = s.client.Get(fmt.Sprintf("%s://%s/v2/", scheme, s.registry))
+		if err != nil {
+			continue
+		}
+		res.Body.Close()
+		s.scheme = scheme
+		return scheme, nil
+	}
+	return "", fmt.Errorf("failed to reach registry %s: %v", s.registry, err)
+}
+
+// checkSecure returns an error if the credentials may not be sent to host
+// over scheme, which is the case of plain http unless the registry is
+// insecure.
+func (s *registrySource) checkSecure(scheme, host string) error {
+	if scheme == "https" || s.insecure {
+		return nil
+	}
+	return fmt.Errorf("refusing to send credentials to %s over %s, registry %s is not insecure", host, scheme, s.registry)
+}
+
+// authorize returns the value of the Authorization header answering the
+// WWW-Authenticate challenge the registry sent over scheme.
+func (s *registrySource) authorize(scheme, challenge string) (string, error) {
+	authScheme, params := parseChallenge(challenge)
+	switch strings.ToLower(authScheme) {
+	case "basic":
+		if s.auth.Username == "" && s.auth.Password == "" {
+			return "", fmt.Errorf("registry %s requires credentials", s.registry)
+		}
+		if err := s.checkSecure(scheme, s.registry); err != nil {
+			return "", err
+		}
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.SetBasicAuth(s.auth.Username, s.auth.Password)
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+		// a token obtained with the credentials is as good as them
+		if s.auth.Username != "" || s.auth.Password != "" || s.auth.IdentityToken != "" {
+			if err := s.checkSecure(scheme, s.registry); err != nil {
+				return "", err
+			}
+		}
+		token, err := s.bearerToken(params["realm"], params["service"], params["scope"])
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	}
+	return "", fmt.Errorf("unsupported authentication scheme %q for registry %s", authScheme, s.registry)
+}
+
+// tokenKey returns the key of the token cache for the token fetched for
+// scope from the token service at realm.
+func tokenKey(realm, service, scope string) string {
+	return realm + " " + service + " " + scope
+}
+
+// forgetToken removes the token cached for the bearer auth challenge from
+// the cache, and returns whether there was one.
+func (s *registrySource) forgetToken(challenge string) bool {
+	authScheme, params := parseChallenge(challenge)
+	if strings.ToLower(authScheme) != "bearer" {
+		return false
+	}
+	key := tokenKey(params["realm"], params["service"], params["scope"])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.tokens[key]
+	delete(s.tokens, key)
+	return ok
+}
+
+// bearerToken fetches a token for scope from the token service at realm,
+// unless one is cached.
+func (s *registrySource) bearerToken(realm, service, scope string) (string, error) {
+	if realm == "" {
+		return "", fmt.Errorf("missing realm in bearer auth challenge of registry %s", s.registry)
+	}
+	key := tokenKey(realm, service, scope)
+	s.mu.Lock()
+	token, ok := s.tokens[key]
+	s.mu.Unlock()
+	if ok {
+		return token, nil
+	}
+
+	var (
+		req *http.Request
+		err error
+	)
+	if s.auth.Username != "" || s.auth.Password != "" || s.auth.IdentityToken != "" {
+		u, err := url.Parse(realm)
+		if err != nil {
+			return "", fmt.Errorf("invalid realm %q in bearer auth challenge of registry %s: %v", realm, s.registry, err)
+		}
+		if err := s.checkSecure(u.Scheme, u.Host); err != nil {
+			return "", err
+		}
+	}
+	if s.auth.IdentityToken != "" {
+		form := url.Values{}
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", s.auth.IdentityToken)
+		form.Set("client_id", "ocid")
+		form.Set("service", service)
+		if scope != "" {
+			form.Set("scope", scope)
+		}
+		req, err = http.NewRequest("POST", realm, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req, err = http.NewRequest("GET", realm, nil)
+		if err != nil {
+			return "", err
+		}
+		q := req.URL.Query()
+		q.Set("service", service)
+		if scope != "" {
+			q.Set("scope", scope)
+		}
+		req.URL.RawQuery = q.Encode()
+		if s.auth.Username != "" || s.auth.Password != "" {
+			req.SetBasicAuth(s.auth.Username, s.auth.Password)
+		}
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to retrieve auth token for registry %s: %s", s.registry, res.Status)
+	}
+	tokenResponse := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&tokenResponse); err != nil {
+		return "", err
+	}
+	token = tokenResponse.Token
+	if token == "" {
+		token = tokenResponse.AccessToken
+	}
+	if token == "" {
+		return "", fmt.Errorf("no token in the auth response of registry %s", s.registry)
+	}
+
+	s.mu.Lock()
+	s.tokens[key] = token
+	s.mu.Unlock()
+	return token, nil
+}
+
+// parseChallenge splits a WWW-Authenticate header into its scheme and its
+// parameters.
+func parseChallenge(header string) (string, map[string]string) {
+	params := make(map[string]string)
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if len(parts) != 2 {
+		return parts[0], params
+	}
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimSpace(rest[eq+1:])
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[key] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return parts[0], params
+}
@@ -0,0 +1,328 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/mount"
+)
+
+const (
+	// layersDir is the directory below the root of the store caching the
+	// unpacked layers, keyed by the digest of their uncompressed content.
+	layersDir = ".layers"
+	// diffIDsDir maps the digest of layer blobs to their diff digest.
+	diffIDsDir = "diffids"
+	// sharedRootfsDir is the directory below the root of the store holding
+	// the read-only root filesystems shared by several containers.
+	sharedRootfsDir = ".rootfs"
+)
+
+// CreateRootfs sets up the root filesystem of a container of img in
+// bundle/rootfs. The layers of the image are unpacked once in the layer
+// cache of the store and the rootfs is an overlay of those, with writes
+// going to bundle/upper. When overlay is not available, the layers are
+// applied to a private copy instead.
+func (s *Store) CreateRootfs(img *Image, bundle string) error {
+	rootfs := filepath.Join(bundle, "rootfs")
+
+	s.lock.RLock()
+	var lowers []string
+	for _, l := range img.Manifest.Layers {
+		dir, err := s.layerDir(l)
+		if err != nil {
+			s.lock.RUnlock()
+			return fmt.Errorf("failed to unpack layer %s of image %s: %v", l, img.ID, err)
+		}
+		// overlay expects the top-most layer first
+		lowers = append([]string{dir}, lowers...)
+	}
+	s.lock.RUnlock()
+
+	err := mountOverlay(lowers, bundle)
+	if err == nil {
+		return nil
+	}
+	logrus.Debugf("falling back to copying the rootfs of %s: %v", bundle, err)
+	for _, d := range []string{"upper", "work"} {
+		if err := os.RemoveAll(filepath.Join(bundle, d)); err != nil {
+			return err
+		}
+	}
+	return s.Unpack(img, rootfs)
+}
+
+// RemoveRootfs tears down the root filesystem set up by CreateRootfs in
+// bundle, unmounting it if needed and removing its private layer.
+func (s *Store) RemoveRootfs(bundle string) error {
+	rootfs := filepath.Join(bundle, "rootfs")
+	mounted, err := mount.Mounted(rootfs)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if mounted {
+		if err := syscall.Unmount(rootfs, syscall.MNT_DETACH); err != nil {
+			return fmt.Errorf("failed to unmount %s: %v", rootfs, err)
+		}
+	}
+	for _, d := range []string{"rootfs", "upper", "work"} {
+		if err := os.RemoveAll(filepath.Join(bundle, d)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SharedRootfs returns a root filesystem of img meant to be used read-only
+// by several containers, such as the infra containers of the pod sandboxes.
+// It is unpacked the first time it is asked for.
+func (s *Store) SharedRootfs(img *Image) (string, error) {
+	dir := s.sharedRootfsPath(img.ID)
+	if _, err := os.Stat(dir); err == nil {
+		return dir, nil
+	}
+
+	tmp, err := ioutil.TempDir(filepath.Join(s.root, stagingDir), "rootfs-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := s.Unpack(img, filepath.Join(tmp, "rootfs")); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(filepath.Join(tmp, "rootfs"), dir); err != nil {
+		// another sandbox unpacked the image in the meantime
+		if _, err1 := os.Stat(dir); err1 != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// sharedRootfsPath returns the directory of the shared rootfs of the image
+// with the given ID.
+func (s *Store) sharedRootfsPath(id string) string {
+	parts := strings.SplitN(id, ":", 2)
+	return filepath.Join(s.root, sharedRootfsDir, parts[0], parts[len(parts)-1])
+}
+
+// mountOverlay mounts the read-only lowers with a private upper dir on
+// bundle/rootfs.
+func mountOverlay(lowers []string, bundle string) error {
+	if len(lowers) == 0 {
+		return fmt.Errorf("overlay needs at least one layer")
+	}
+	if !overlaySupported() {
+		return fmt.Errorf("overlay is not supported by the kernel")
+	}
+	upper := filepath.Join(bundle, "upper")
+	work := filepath.Join(bundle, "work")
+	rootfs := filepath.Join(bundle, "rootfs")
+	for _, d := range []string{upper, work, rootfs} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lowers, ":"), upper, work)
+	if len(options) >= syscall.Getpagesize() {
+		return fmt.Errorf("too many layers to mount an overlay")
+	}
+	return syscall.Mount("overlay", rootfs, "overlay", 0, options)
+}
+
+// overlaySupported returns whether the kernel knows about overlayfs.
+func overlaySupported() bool {
+	filesystems, err := ioutil.ReadFile("/proc/filesystems")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(filesystems), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[len(fields)-1] == "overlay" {
+			return true
+		}
+	}
+	return false
+}
+
+// layerDir returns the directory the layer blob is unpacked in, unpacking
+// it first if it is not cached yet.
+func (s *Store) layerDir(blob string) (string, error) {
+	mapping := filepath.Join(s.root, layersDir, diffIDsDir, strings.Replace(blob, ":", "-", 1))
+	if diffID, err := ioutil.ReadFile(mapping); err == nil {
+		dir := s.diffDir(string(diffID))
+		if _, err := os.Stat(dir); err == nil {
+			return dir, nil
+		}
+	}
+
+	tmp, err := ioutil.TempDir(filepath.Join(s.root, stagingDir), "layer-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	diffID, err := s.untarLayer(blob, filepath.Join(tmp, "diff"))
+	if err != nil {
+		return "", err
+	}
+	dir := s.diffDir(diffID)
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(filepath.Join(tmp, "diff"), dir); err != nil {
+		// another container unpacked the same layer in the meantime
+		if _, err1 := os.Stat(dir); err1 != nil {
+			return "", err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(mapping), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "diffid"), []byte(diffID), 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(filepath.Join(tmp, "diffid"), mapping); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// collectLayers removes the cached layers of the blobs no ref uses, along
+// with their diff digest mappings. The layers still mounted as the lower
+// dirs of an overlay are kept, as containers of removed images may be
+// running on them.
+func (s *Store) collectLayers(refs []*storedRef) error {
+	inUse := make(map[string]bool)
+	for _, r := range refs {
+		for _, l := range r.manifest.Layers {
+			inUse[l] = true
+		}
+	}
+	keep, err := overlayLowers()
+	if err != nil {
+		return err
+	}
+
+	mappings := filepath.Join(s.root, layersDir, diffIDsDir)
+	files, err := ioutil.ReadDir(mappings)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, f := range files {
+		mapping := filepath.Join(mappings, f.Name())
+		diffID, err := ioutil.ReadFile(mapping)
+		if err != nil {
+			return err
+		}
+		if inUse[strings.Replace(f.Name(), "-", ":", 1)] && validateDigest(string(diffID)) == nil {
+			keep[s.diffDir(string(diffID))] = true
+			continue
+		}
+		logrus.Debugf("removing unreferenced layer mapping %s", mapping)
+		if err := os.Remove(mapping); err != nil {
+			return err
+		}
+	}
+
+	algs, err := ioutil.ReadDir(filepath.Join(s.root, layersDir))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, alg := range algs {
+		if !alg.IsDir() || alg.Name() == diffIDsDir {
+			continue
+		}
+		dirs, err := ioutil.ReadDir(filepath.Join(s.root, layersDir, alg.Name()))
+		if err != nil {
+			return err
+		}
+		for _, d := range dirs {
+			dir := filepath.Join(s.root, layersDir, alg.Name(), d.Name())
+			if keep[dir] {
+				continue
+			}
+			logrus.Debugf("removing unreferenced layer %s", dir)
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// overlayLowers returns the lower dirs of the mounted overlays.
+func overlayLowers() (map[string]bool, error) {
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		return nil, err
+	}
+	lowers := make(map[string]bool)
+	for _, m := range mounts {
+		if m.Fstype != "overlay" {
+			continue
+		}
+		for _, opt := range strings.Split(m.VfsOpts, ",") {
+			if strings.HasPrefix(opt, "lowerdir=") {
+				for _, l := range strings.Split(strings.TrimPrefix(opt, "lowerdir="), ":") {
+					lowers[l] = true
+				}
+			}
+		}
+	}
+	return lowers, nil
+}
+
+// diffDir returns the directory of the layer cache for a diff digest.
+func (s *Store) diffDir(diffID string) string {
+	parts := strings.SplitN(diffID, ":", 2)
+	return filepath.Join(s.root, layersDir, parts[0], parts[len(parts)-1])
+}
+
+// untarLayer unpacks the layer blob in dest, with whiteouts in the overlay
+// format, and returns the digest of its uncompressed content.
+func (s *Store) untarLayer(blob, dest string) (string, error) {
+	p, err := s.blobPath(blob)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	r, err := archive.DecompressStream(f)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	tee := io.TeeReader(r, h)
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return "", err
+	}
+	if err := archive.UntarUncompressed(tee, dest, &archive.TarOptions{WhiteoutFormat: archive.OverlayWhiteoutFormat}); err != nil {
+		return "", err
+	}
+	// the tar reader may stop before the padding at the end of the stream
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,362 @@
+// Package storage manages the images pulled by ocid.
+//
+// Every image is stored in its own directory below the root of the store,
+// named after the reference it was pulled with (e.g. busybox:latest), which
+// holds the manifest of the image. The blobs the manifests reference are
+// shared by all the images and stored by digest.
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/reference"
+)
+
+const manifestFile = "manifest.json"
+
+// ErrImageUnknown is returned when an image cannot be found in the store.
+var ErrImageUnknown = errors.New("image not known")
+
+// Store gives access to the images kept in a directory.
+type Store struct {
+	root string
+	// lock is held for reading by pulls and for writing by removals, so
+	// that no blob is removed while a pull relies on it being present.
+	lock sync.RWMutex
+}
+
+// New creates a Store rooted at root.
+func New(root string) (*Store, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	s := &Store{root: root}
+	if err := s.cleanupStaging(); err != nil {
+		return nil, err
+	}
+	if err := s.migrateBlobs(); err != nil {
+		return nil, err
+	}
+	if err := s.collectGarbage(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Root returns the directory the images are stored in.
+func (s *Store) Root() string {
+	return s.root
+}
+
+// Image describes an image held by the store. The same image may have been
+// pulled under several names.
+type Image struct {
+	// ID is the digest of the config of the image, or of its manifest for
+	// images which do not have a separate config blob.
+	ID string
+	// RepoTags are the tagged references the image was pulled with.
+	RepoTags []string
+	// RepoDigests are the references of the image by manifest digest.
+	RepoDigests []string
+	// Size is the size of all the blobs of the image.
+	Size uint64
+	// Manifest is the manifest of the image.
+	Manifest *Manifest
+
+	refs []*storedRef
+}
+
+// storedRef is a directory of the store holding an image.
+type storedRef struct {
+	name     string
+	dir      string
+	ref      reference.Named
+	manifest *Manifest
+}
+
+// imageID returns the ID of the image described by m.
+func imageID(m *Manifest) string {
+	if m.Config != "" {
+		return m.Config
+	}
+	return m.Digest
+}
+
+// refs returns every image directory found in the store.
+func (s *Store) refs() ([]*storedRef, error) {
+	var refs []*storedRef
+	err := filepath.Walk(s.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		// no image reference component may start with a dot, which leaves
+		// those names free for the store's own bookkeeping.
+		if path != s.root && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		raw, err := ioutil.ReadFile(filepath.Join(path, manifestFile))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		m, err := parseManifest(raw)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+		r := &storedRef{
+			name:     name,
+			dir:      path,
+			manifest: m,
+		}
+		if ref, err := reference.ParseNamed(name); err == nil {
+			r.ref = ref
+		}
+		refs = append(refs, r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// Images returns all the images of the store.
+func (s *Store) Images() ([]*Image, error) {
+	refs, err := s.refs()
+	if err != nil {
+		return nil, err
+	}
+
+	var images []*Image
+	byID := make(map[string]*Image)
+	for _, r := range refs {
+		id := imageID(r.manifest)
+		img, ok := byID[id]
+		if !ok {
+			img = &Image{
+				ID:       id,
+				Manifest: r.manifest,
+			}
+			byID[id] = img
+			images = append(images, img)
+		}
+		img.refs = append(img.refs, r)
+	}
+
+	for _, img := range images {
+		if err := img.fill(s); err != nil {
+			return nil, err
+		}
+	}
+	sort.Sort(byImageID(images))
+	return images, nil
+}
+
+// fill computes the names and the size of the image from its references.
+func (img *Image) fill(s *Store) error {
+	tags := make(map[string]bool)
+	digests := make(map[string]bool)
+	for _, r := range img.refs {
+		if r.ref == nil {
+			tags[r.name] = true
+			continue
+		}
+		if _, ok := r.ref.(reference.NamedTagged); ok {
+			tags[r.ref.String()] = true
+		}
+		digests[r.ref.Name()+"@"+r.manifest.Digest] = true
+	}
+	img.RepoTags = sortedKeys(tags)
+	img.RepoDigests = sortedKeys(digests)
+
+	img.Size = 0
+	for _, b := range img.Manifest.Blobs() {
+		p, err := s.blobPath(b)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		img.Size += uint64(fi.Size())
+	}
+	return nil
+}
+
+// Lookup returns the image matching name, which is either an image ID or a
+// reference the image was pulled with, with or without the docker://
+// transport prefix.
+func (s *Store) Lookup(name string) (*Image, error) {
+	images, err := s.Images()
+	if err != nil {
+		return nil, err
+	}
+	for _, img := range images {
+		if img.Matches(name) {
+			return img, nil
+		}
+	}
+	return nil, ErrImageUnknown
+}
+
+// Matches returns whether the image is known by name.
+func (img *Image) Matches(name string) bool {
+	return img.isID(name) || len(img.refsNamed(name)) > 0
+}
+
+// isID returns whether name is the ID of the image.
+func (img *Image) isID(name string) bool {
+	return name == img.ID || "sha256:"+name == img.ID
+}
+
+// refsNamed returns the references of the image known by name.
+func (img *Image) refsNamed(name string) []*storedRef {
+	var refs []*storedRef
+	for _, r := range img.refs {
+		if r.matches(name) {
+			refs = append(refs, r)
+		}
+	}
+	return refs
+}
+
+// matches returns whether the reference is known by name.
+func (r *storedRef) matches(name string) bool {
+
+	name = strings.TrimPrefix(strings.TrimPrefix(name, "docker:"), "//")
+	ref, err := reference.ParseNamed(name)
+	if err != nil || r.ref == nil {
+		return r.name == name
+	}
+	key := refKey(reference.WithDefaultTag(ref))
+	return refKey(r.ref) == key || r.ref.FullName()+"@"+r.manifest.Digest == key
+}
+
+// HasOtherNames returns whether the image remains known under other names
+// once name is removed.
+func (img *Image) HasOtherNames(name string) bool {
+	if img.isID(name) {
+		return false
+	}
+	return len(img.refsNamed(name)) < len(img.refs)
+}
+
+// Remove deletes the image known as name from the store. If name is the ID
+// of the image, the image is removed under all of its names. The manifest of
+// the removed references is deleted along with the blobs no other image
+// of the store references, along with their cached layers, and the shared
+// rootfs of the image once none of its names is left.
+func (s *Store) Remove(img *Image, name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	removed := img.refs
+	if !img.isID(name) {
+		removed = img.refsNamed(name)
+	}
+	if len(removed) == 0 {
+		return ErrImageUnknown
+	}
+	gone := make(map[string]bool)
+	for _, r := range removed {
+		gone[r.dir] = true
+	}
+
+	refs, err := s.refs()
+	if err != nil {
+		return err
+	}
+	var kept []*storedRef
+	inUse := make(map[string]bool)
+	for _, r := range refs {
+		if gone[r.dir] {
+			continue
+		}
+		kept = append(kept, r)
+		for _, b := range r.manifest.Blobs() {
+			inUse[b] = true
+		}
+	}
+
+	for _, r := range removed {
+		if err := os.Remove(filepath.Join(r.dir, manifestFile)); err != nil {
+			return err
+		}
+		s.pruneDir(r.dir)
+		for _, b := range r.manifest.Blobs() {
+			if inUse[b] {
+				continue
+			}
+			p, err := s.blobPath(b)
+			if err != nil {
+				return err
+			}
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	if len(removed) == len(img.refs) {
+		if err := os.RemoveAll(s.sharedRootfsPath(img.ID)); err != nil {
+			return err
+		}
+	}
+	if err := s.collectLayers(kept); err != nil {
+		logrus.Warnf("failed to collect the layers of image %s: %v", img.ID, err)
+	}
+	return nil
+}
+
+// pruneDir removes dir and its parents up to the root of the store as long
+// as they are empty.
+func (s *Store) pruneDir(dir string) {
+	for dir != s.root && strings.HasPrefix(dir, s.root) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// refKey returns a fully qualified form of ref suitable for comparisons.
+func refKey(ref reference.Named) string {
+	switch r := ref.(type) {
+	case reference.Canonical:
+		return r.FullName() + "@" + r.Digest().String()
+	case reference.NamedTagged:
+		return r.FullName() + ":" + r.Tag()
+	}
+	return ref.FullName()
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type byImageID []*Image
+
+func (a byImageID) Len() int           { return len(a) }
+func (a byImageID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byImageID) Less(i, j int) bool { return a[i].ID < a[j].ID }
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/docker/docker/pkg/archive"
+)
+
+// Unpack builds the root filesystem of img in dest by applying its layers
+// in order. Whiteouts, hard links, device nodes and ownership are handled
+// the way docker does.
+func (s *Store) Unpack(img *Image, dest string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	for _, l := range img.Manifest.Layers {
+		if err := s.applyLayer(l, dest); err != nil {
+			return fmt.Errorf("failed to apply layer %s of image %s: %v", l, img.ID, err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) applyLayer(blob, dest string) error {
+	p, err := s.blobPath(blob)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = archive.ApplyLayer(dest, f)
+	return err
+}
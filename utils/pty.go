@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Ioctl is a way to make the ioctl linux syscall
+func Ioctl(fd, req, arg uintptr) error {
+	_, _, e1 := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	if e1 != 0 {
+		return e1
+	}
+	return nil
+}
+
+// OpenPty allocates a new pseudo terminal and returns its master and slave
+// ends. The master supports deadlines.
+func OpenPty() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var unlock int32
+	if err := fileIoctl(master, func(fd uintptr) error {
+		return Ioctl(fd, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock)))
+	}); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to unlock pty: %v", err)
+	}
+
+	var n uint32
+	if err := fileIoctl(master, func(fd uintptr) error {
+		return Ioctl(fd, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n)))
+	}); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to get pty number: %v", err)
+	}
+
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// winsize is the struct winsize of the TIOCGWINSZ and TIOCSWINSZ ioctls.
+type winsize struct {
+	Row    uint16
+	Col    uint16
+	Xpixel uint16
+	Ypixel uint16
+}
+
+// SetWinsize sets the size of the terminal fd.
+func SetWinsize(fd uintptr, width, height uint16) error {
+	ws := winsize{Row: height, Col: width}
+	return Ioctl(fd, syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+}
+
+// GetWinsize returns the size of the terminal fd.
+func GetWinsize(fd uintptr) (width, height uint16, err error) {
+	var ws winsize
+	if err := Ioctl(fd, syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws))); err != nil {
+		return 0, 0, err
+	}
+	return ws.Col, ws.Row, nil
+}
+
+// SetFileWinsize sets the size of the terminal f. Unlike going through
+// f.Fd, it leaves f in non-blocking mode if it is.
+func SetFileWinsize(f *os.File, width, height uint16) error {
+	return fileIoctl(f, func(fd uintptr) error {
+		return SetWinsize(fd, width, height)
+	})
+}
+
+// fileIoctl runs ioctl on the descriptor of f, which f keeps open until
+// ioctl returns.
+func fileIoctl(f *os.File, ioctl func(fd uintptr) error) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ioctlErr error
+	if err := rc.Control(func(fd uintptr) {
+		ioctlErr = ioctl(fd)
+	}); err != nil {
+		return err
+	}
+	return ioctlErr
+}
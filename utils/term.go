@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// IsTerminal returns whether fd is a terminal.
+func IsTerminal(fd uintptr) bool {
+	var termios syscall.Termios
+	return Ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&termios))) == nil
+}
+
+// SetRawTerminal puts the terminal fd in raw mode, so that input is passed
+// on as typed, and returns its previous state.
+func SetRawTerminal(fd uintptr) (*syscall.Termios, error) {
+	var state syscall.Termios
+	if err := Ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&state))); err != nil {
+		return nil, err
+	}
+
+	raw := state
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := Ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(&raw))); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// RestoreTerminal puts the terminal fd back in state.
+func RestoreTerminal(fd uintptr, state *syscall.Termios) error {
+	return Ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(state)))
+}
@@ -6,9 +6,10 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
-	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 )
@@ -59,46 +60,76 @@ func Prctl(option int, arg2, arg3, arg4, arg5 uintptr) (err error) {
 	return
 }
 
-// CreateFakeRootfs creates a fake rootfs for test.
-func CreateFakeRootfs(dir string, image string) error {
-	if len(image) <= 9 || image[:9] != "docker://" {
-		return fmt.Errorf("CreateFakeRootfs only support docker images currently")
-	}
+// reapedProcess is the exit information of a child process collected by the reaper.
+type reapedProcess struct {
+	status syscall.WaitStatus
+	time   time.Time
+}
 
-	rootfs := filepath.Join(dir, "rootfs")
-	if err := os.MkdirAll(rootfs, 0755); err != nil {
-		return err
-	}
+// reapedTTL is how long the exit information of a reaped process is kept.
+// Most processes reaped are of no interest to anyone, and those which are
+// get looked up right after they exit.
+const reapedTTL = time.Minute
 
-	// docker export $(docker create image[9:]) | tar -C rootfs -xf -
-	return dockerExport(image[9:], rootfs)
-}
+var (
+	reapedMu sync.Mutex
+	reaped   = make(map[int]reapedProcess)
+)
 
-func dockerExport(image string, rootfs string) error {
-	out, err := ExecCmd("docker", "create", image)
-	if err != nil {
-		return err
+// addReaped records the exit information of the process pid and forgets
+// the processes reaped more than reapedTTL ago.
+func addReaped(pid int, status syscall.WaitStatus) {
+	now := time.Now()
+	reapedMu.Lock()
+	defer reapedMu.Unlock()
+	for p, r := range reaped {
+		if now.Sub(r.time) > reapedTTL {
+			delete(reaped, p)
+		}
 	}
+	reaped[pid] = reapedProcess{status: status, time: now}
+}
 
-	container := out[:strings.Index(out, "\n")]
+// ReapedStatus returns the wait status and the time of exit of a process
+// reaped by the reaper. The information is released once it has been returned.
+func ReapedStatus(pid int) (syscall.WaitStatus, time.Time, bool) {
+	reapedMu.Lock()
+	defer reapedMu.Unlock()
+	p, ok := reaped[pid]
+	if ok {
+		delete(reaped, pid)
+	}
+	return p.status, p.time, ok
+}
 
-	cmd := fmt.Sprintf("docker export %s | tar -C %s -xf -", container, rootfs)
-	if _, err := ExecCmd("/bin/bash", "-c", cmd); err != nil {
-		err1 := dockerRemove(container)
-		if err1 == nil {
-			return err
+// WaitExitCode waits for cmd to exit and returns the exit code of the
+// process. The process may have been collected by the reaper before
+// cmd.Wait got to it, in which case the status recorded by the reaper is used.
+func WaitExitCode(cmd *exec.Cmd) (int32, error) {
+	err := cmd.Wait()
+	if err == nil {
+		return 0, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return ExitCode(exitErr.Sys().(syscall.WaitStatus)), nil
+	}
+	// give the reaper a chance to record the status
+	for i := 0; i < 50; i++ {
+		if status, _, ok := ReapedStatus(cmd.Process.Pid); ok {
+			return ExitCode(status), nil
 		}
-		return fmt.Errorf("%v; %v", err, err1)
+		time.Sleep(10 * time.Millisecond)
 	}
-
-	return dockerRemove(container)
+	return -1, err
 }
 
-func dockerRemove(container string) error {
-	if _, err := ExecCmd("docker", "rm", container); err != nil {
-		return err
+// ExitCode converts a wait status to the exit code reported by shells, i.e.
+// 128+signal for processes that were killed by a signal.
+func ExitCode(status syscall.WaitStatus) int32 {
+	if status.Signaled() {
+		return 128 + int32(status.Signal())
 	}
-	return nil
+	return int32(status.ExitStatus())
 }
 
 // StartReaper starts a goroutine to reap processes
@@ -113,11 +144,14 @@ func StartReaper() {
 			logrus.Infof("Signal received: %v", sig)
 			for {
 				// Reap processes
-				cpid, _ := syscall.Wait4(-1, nil, syscall.WNOHANG, nil)
+				var status syscall.WaitStatus
+				cpid, _ := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
 				if cpid < 1 {
 					break
 				}
 
+				addReaped(cpid, status)
+
 				logrus.Infof("Reaped process with pid %d", cpid)
 			}
 		}